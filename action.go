@@ -15,15 +15,15 @@
 package main
 
 import (
+	`context`
 	`fmt`
 	`io/ioutil`
-	`os`
 	`path/filepath`
 	`github.com/jscherff/cmdb/ci/peripheral/usb`
 )
 
 // audit performs a change audit against properties from the last checkin.
-func audit(dev usb.Auditer) (err error) {
+func audit(ctx context.Context, dev usb.Auditer) (err error) {
 
 	var (
 		j []byte
@@ -37,11 +37,11 @@ func audit(dev usb.Auditer) (err error) {
 		return err
 	}
 
-	sl.Printf(`device %s-%s-%s fetching previous state from server`,
+	sl.Printf(`device %s-%s-%s fetching previous state`,
 		dev.VID(), dev.PID(), dev.SN(),
 	)
 
-	if j, err = checkout(dev); err != nil {
+	if j, err = backend.Checkout(ctx, dev); err != nil {
 		sl.Printf(`device %s-%s-%s skipping audit: no previous state`,
 			dev.VID(), dev.PID(), dev.SN(),
 		)
@@ -52,11 +52,11 @@ func audit(dev usb.Auditer) (err error) {
 		return err
 	}
 
-	sl.Printf(`device %s-%s-%s saving current state to server`,
+	sl.Printf(`device %s-%s-%s saving current state`,
 		dev.VID(), dev.PID(), dev.SN(),
 	)
 
-	if err := checkin(dev); err != nil {
+	if err := backend.Checkin(ctx, dev); err != nil {
 		el.Print(err) // err occluded later by sendAudit()
 	}
 
@@ -71,19 +71,21 @@ func audit(dev usb.Auditer) (err error) {
 		dev.VID(), dev.PID(), dev.SN(),
 	)
 
+	status.Changes(ch)
+
 	for _, c := range ch {
 		cl.Printf(`device %s-%s-%s modified: '%s' was '%s', now '%s'`,
 			dev.VID(), dev.PID(), dev.SN(), c[0], c[1], c[2],
 		)
 	}
 
-	sl.Printf(`device %s-%s-%s reporting changes to server`,
+	sl.Printf(`device %s-%s-%s reporting changes`,
 		dev.VID(), dev.PID(), dev.SN(),
 	)
 
 	dev.SetChanges(ch)
 
-	return sendAudit(dev)
+	return backend.SendAudit(ctx, dev)
 }
 
 // report processes options and writes report to the selected destination.
@@ -114,7 +116,7 @@ func report(dev usb.Reporter) (err error) {
 	}
 
 	if *fReportConsole {
-		fmt.Fprintln(os.Stdout, string(b))
+		fmt.Fprintln(Console, string(b))
 		return nil
 	}
 
@@ -130,7 +132,7 @@ func report(dev usb.Reporter) (err error) {
 }
 
 // serial processes options and configures the the serial number.
-func serial(dev usb.Serializer) (err error) {
+func serial(ctx context.Context, dev usb.Serializer) (err error) {
 
 	var s string
 
@@ -169,7 +171,12 @@ func serial(dev usb.Serializer) (err error) {
 			dev.VID(), dev.PID(),
 		)
 
-		if s, err = newSn(dev); err != nil {
+		if s, err = backend.NewSn(ctx, dev); apiErrorCode(err) == ErrCodeDuplicateSerial {
+			err = fmt.Errorf(`device %s-%s serial number '%s' already registered, use -erase to replace it - %w`,
+				dev.VID(), dev.PID(), dev.SN(), err,
+			)
+			break
+		} else if err != nil {
 			break
 		}
 
@@ -197,7 +204,7 @@ func showState(dev usb.Analyzer) (error) {
 	if state, err := dev.GetState(); err != nil {
 		return err
 	} else {
-		fmt.Println(state)
+		fmt.Fprintln(Console, state)
 	}
 
 	return nil
@@ -0,0 +1,100 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`errors`
+	`fmt`
+	`strings`
+)
+
+// Error codes returned by the server in rejected responses.
+const (
+	ErrCodeBadRequest = `bad_request`
+	ErrCodeDuplicateSerial = `duplicate_serial`
+	ErrCodeInvalidJSON = `invalid_json`
+	ErrCodeNotFound = `not_found`
+	ErrCodeNotImplemented = `not_implemented`
+	ErrCodeUnauthorized = `unauthorized`
+)
+
+// APIError is a request rejected by the server. Servers that return a
+// structured error body supply the code, message, field errors, and
+// request ID; for other servers the message is the raw response body.
+type APIError struct {
+	Status httpStatus			`json:"-"`
+	Code string				`json:"code,omitempty"`
+	Message string				`json:"message"`
+	Fields []FieldError			`json:"fields,omitempty"`
+	RequestID string			`json:"request_id,omitempty"`
+}
+
+// FieldError is a rejected field of a submitted object.
+type FieldError struct {
+	Field string				`json:"field"`
+	Message string				`json:"message"`
+}
+
+// newAPIError builds an APIError from a rejected response.
+func newAPIError(hr *httpResult) (*APIError) {
+
+	this := &APIError{Status: hr.Status()}
+
+	if err := hr.Content().Decode(this); err != nil || this.Message == `` {
+		*this = APIError{Status: hr.Status(), Message: hr.Content().String()}
+	}
+
+	if this.RequestID == `` && hr.header != nil {
+		this.RequestID = hr.header.Get(`X-Request-ID`)
+	}
+
+	this.Message = strings.TrimSpace(this.Message)
+
+	return this
+}
+
+// Error implements the error interface for APIError. Without a code or
+// field errors the text matches that of the raw response.
+func (this *APIError) Error() (string) {
+
+	s := fmt.Sprintf(`%s: %s`, this.Status, this.Message)
+
+	if this.Code != `` {
+		s += ` (` + this.Code + `)`
+	}
+
+	for _, f := range this.Fields {
+		s += fmt.Sprintf(`; %s: %s`, f.Field, f.Message)
+	}
+
+	if this.RequestID != `` {
+		s += ` [request ` + this.RequestID + `]`
+	}
+
+	return s
+}
+
+// apiErrorCode returns the server error code of the APIError in the chain
+// of err, or an empty string if there is none.
+func apiErrorCode(err error) (string) {
+
+	var ae *APIError
+
+	if errors.As(err, &ae) {
+		return ae.Code
+	}
+
+	return ``
+}
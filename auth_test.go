@@ -1,7 +1,14 @@
 package main
 
 import (
+	`bytes`
+	`context`
+	`io/ioutil`
+	`net/http`
+	`net/url`
+	`strings`
 	`testing`
+	`time`
 	`github.com/jscherff/gotest`
 )
 
@@ -14,7 +21,7 @@ func TestAuth(t *testing.T) {
 
 	t.Run(`Success with Good Credentials`, func(t *testing.T) {
 
-		err = auth()
+		err = auth(context.Background())
 		gotest.Ok(t, err)
 	})
 
@@ -27,7 +34,7 @@ func TestAuth(t *testing.T) {
 		conf.Server.Auth.Username = `baduser`
 		conf.Server.Auth.Password = goodPassword
 
-		err = auth()
+		err = auth(context.Background())
 		conf.Server.Auth.Username = goodUsername
 		gotest.Assert(t, err != nil, `authentication with bad username should fail`)
 	})
@@ -41,8 +48,68 @@ func TestAuth(t *testing.T) {
 		conf.Server.Auth.Username = goodUsername
 		conf.Server.Auth.Password = `badpass`
 
-		err = auth()
+		err = auth(context.Background())
 		conf.Server.Auth.Password = goodPassword
 		gotest.Assert(t, err != nil, `authentication with bad password should fail`)
 	})
+
+	t.Run(`Reauthentication after Token Expiry`, func(t *testing.T) {
+
+		mux.Lock()
+		defer mux.Unlock()
+
+		fs := useFakeServer(t)
+
+		resetFlags(t)
+		*fGlobalForceCheckin = true
+
+		// Count authentications and record the bodies of the POSTs
+		// sent to the server.
+
+		var auths int
+		var posts []string
+
+		authPath := strings.Split(conf.Server.Endpoints[`cmdb_auth`], `%s`)[0]
+		transport := httpClient.Transport
+		defer func() { httpClient.Transport = transport }()
+
+		httpClient.Transport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+
+			if strings.HasPrefix(r.URL.Path, authPath) {
+				auths++
+			} else if r.Method == http.MethodPost {
+				b, err := ioutil.ReadAll(r.Body)
+				if err != nil {
+					return nil, err
+				}
+				r.Body = ioutil.NopCloser(bytes.NewReader(b))
+				posts = append(posts, string(b))
+			}
+
+			return transport.RoundTrip(r)
+		})
+
+		err = auth(context.Background())
+		gotest.Ok(t, err)
+		gotest.Assert(t, auths == 1, `client should authenticate once`)
+
+		// Replace the session token with one that has expired without
+		// clearing the flag, so the server refuses the next request.
+
+		u, err := url.Parse(servers.Current().URL())
+		gotest.Ok(t, err)
+
+		httpClient.Jar.SetCookies(u, []*http.Cookie{{
+			Name: FakeTokenCookie,
+			Value: fs.token(conf.Server.Auth.Username, time.Now().Add(-time.Minute)),
+			Path: `/`,
+		}})
+
+		err = checkin(context.Background(), td.Mag[`mag1`])
+		gotest.Ok(t, err)
+		gotest.Assert(t, authenticated, `client should be reauthenticated`)
+		gotest.Assert(t, auths == 2, `client should authenticate exactly once more`)
+		gotest.Assert(t, len(posts) == 2, `checkin should be sent and replayed once`)
+		gotest.Assert(t, posts[0] == posts[1], `replayed checkin should match the original`)
+	})
 }
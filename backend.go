@@ -0,0 +1,271 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`context`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`strings`
+	`github.com/jscherff/cmdb/ci/peripheral/usb`
+)
+
+// Backend is a configuration management database that stores device
+// information, issues serial numbers, and records audit results.
+type Backend interface {
+	NewSn(ctx context.Context, dev usb.Serializer) (string, error)
+	Checkin(ctx context.Context, dev usb.Reporter) (error)
+	CheckinBatch(ctx context.Context, devs []usb.Reporter) ([]error)
+	Checkout(ctx context.Context, dev usb.Auditer) ([]byte, error)
+	SendAudit(ctx context.Context, dev usb.Auditer) (error)
+	Vendor(ctx context.Context, dev usb.Updater) (string, error)
+	Product(ctx context.Context, dev usb.Updater) (string, error)
+	Class(ctx context.Context, c string) (string, error)
+	SubClass(ctx context.Context, c, s string) (string, error)
+	Protocol(ctx context.Context, c, s, p string) (string, error)
+}
+
+// newBackend creates the backend selected in the configuration.
+func newBackend(kind, dir string) (Backend, error) {
+
+	switch kind {
+
+	case ``, `rest`:
+		return &restBackend{}, nil
+
+	case `file`:
+		return newFileBackend(dir)
+
+	default:
+		return nil, fmt.Errorf(`unsupported backend '%s'`, kind)
+	}
+}
+
+// restBackend is the Backend provided by the cmdbd server REST API.
+type restBackend struct{}
+
+// NewSn obtains a serial number from the server.
+func (this *restBackend) NewSn(ctx context.Context, dev usb.Serializer) (string, error) {
+	return newSn(ctx, dev)
+}
+
+// Checkin checks a device in with the server.
+func (this *restBackend) Checkin(ctx context.Context, dev usb.Reporter) (error) {
+	return checkin(ctx, dev)
+}
+
+// CheckinBatch checks a group of devices in with the server.
+func (this *restBackend) CheckinBatch(ctx context.Context, devs []usb.Reporter) ([]error) {
+	return checkinBatch(ctx, devs)
+}
+
+// Checkout obtains the last checkin of a device from the server.
+func (this *restBackend) Checkout(ctx context.Context, dev usb.Auditer) ([]byte, error) {
+	return checkout(ctx, dev)
+}
+
+// SendAudit submits audit results to the server.
+func (this *restBackend) SendAudit(ctx context.Context, dev usb.Auditer) (error) {
+	return sendAudit(ctx, dev)
+}
+
+// Vendor obtains the vendor name from the server.
+func (this *restBackend) Vendor(ctx context.Context, dev usb.Updater) (string, error) {
+	return vendor(ctx, dev)
+}
+
+// Product obtains the product name from the server.
+func (this *restBackend) Product(ctx context.Context, dev usb.Updater) (string, error) {
+	return product(ctx, dev)
+}
+
+// Class obtains the class name from the server.
+func (this *restBackend) Class(ctx context.Context, c string) (string, error) {
+	return class(ctx, c)
+}
+
+// SubClass obtains the subclass name from the server.
+func (this *restBackend) SubClass(ctx context.Context, c, s string) (string, error) {
+	return subclass(ctx, c, s)
+}
+
+// Protocol obtains the protocol name from the server.
+func (this *restBackend) Protocol(ctx context.Context, c, s, p string) (string, error) {
+	return protocol(ctx, c, s, p)
+}
+
+// fileBackend is a Backend stored in a local directory for sites without
+// server connectivity. The latest checkin of each device is kept in the
+// devices subdirectory, and every checkin and audit is also queued in the
+// outbox subdirectory, in spool format, for later delivery to the server.
+type fileBackend struct {
+	Dir string
+	Outbox *Spool
+}
+
+// newFileBackend creates a file backend rooted in the given directory.
+func newFileBackend(dir string) (*fileBackend, error) {
+
+	this := &fileBackend{Dir: dir, Outbox: &Spool{filepath.Join(dir, `outbox`)}}
+
+	if _, err := makePath(filepath.Join(dir, `devices`)); err != nil {
+		return nil, err
+	}
+
+	if _, err := makePath(this.Outbox.Dir); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// NewSn always fails; serial numbers must be unique across the enterprise
+// and can only be issued by the server.
+func (this *fileBackend) NewSn(ctx context.Context, dev usb.Serializer) (string, error) {
+	return ``, fmt.Errorf(`serial number not generated - file backend cannot issue serial numbers`)
+}
+
+// Checkin saves the device as its latest checkin and queues it for the server.
+func (this *fileBackend) Checkin(ctx context.Context, dev usb.Reporter) (error) {
+
+	j, err := dev.JSON()
+
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(this.devicePath(dev), j, FileMode); err != nil {
+		return err
+	}
+
+	sl.Printf(`checkin saved to %s`, this.Dir)
+
+	return this.Outbox.Put(`usb_ci_checkin`,
+		[]string{conf.Client.HostName, dev.VID(), dev.PID()}, j,
+	)
+}
+
+// CheckinBatch saves each device in a group as its latest checkin.
+func (this *fileBackend) CheckinBatch(ctx context.Context, devs []usb.Reporter) ([]error) {
+
+	errs := make([]error, len(devs))
+
+	for i, dev := range devs {
+		errs[i] = this.Checkin(ctx, dev)
+	}
+
+	return errs
+}
+
+// Checkout loads the latest checkin of a serialized device.
+func (this *fileBackend) Checkout(ctx context.Context, dev usb.Auditer) ([]byte, error) {
+
+	if dev.SN() == `` {
+		sl.Printf(`device %s-%s skipping fetch, no SN`, dev.VID(), dev.PID())
+		return nil, nil
+	}
+
+	if j, err := ioutil.ReadFile(this.devicePath(dev)); os.IsNotExist(err) {
+		return nil, fmt.Errorf(`device not retreived - no checkin in %s`, this.Dir)
+	} else if err != nil {
+		return nil, err
+	} else {
+		sl.Printf(`device retrieved from %s`, this.Dir)
+		return j, nil
+	}
+}
+
+// SendAudit queues the audit results for the server.
+func (this *fileBackend) SendAudit(ctx context.Context, dev usb.Auditer) (error) {
+
+	if j, err := json.Marshal(dev.GetChanges()); err != nil {
+		return err
+	} else {
+		return this.Outbox.Put(`usb_ci_audit`,
+			[]string{conf.Client.HostName, dev.VID(), dev.PID(), dev.SN()}, j,
+		)
+	}
+}
+
+// Vendor always fails; vendor names are only available from the server.
+func (this *fileBackend) Vendor(ctx context.Context, dev usb.Updater) (string, error) {
+	return ``, fmt.Errorf(`vendor lookup failed - not supported by file backend`)
+}
+
+// Product always fails; product names are only available from the server.
+func (this *fileBackend) Product(ctx context.Context, dev usb.Updater) (string, error) {
+	return ``, fmt.Errorf(`product lookup failed - not supported by file backend`)
+}
+
+// Class always fails; class names are only available from the server.
+func (this *fileBackend) Class(ctx context.Context, c string) (string, error) {
+	return ``, fmt.Errorf(`class lookup failed - not supported by file backend`)
+}
+
+// SubClass always fails; subclass names are only available from the server.
+func (this *fileBackend) SubClass(ctx context.Context, c, s string) (string, error) {
+	return ``, fmt.Errorf(`subclass lookup failed - not supported by file backend`)
+}
+
+// Protocol always fails; protocol names are only available from the server.
+func (this *fileBackend) Protocol(ctx context.Context, c, s, p string) (string, error) {
+	return ``, fmt.Errorf(`protocol lookup failed - not supported by file backend`)
+}
+
+// Sync delivers the queued checkins and audits to the server. It returns
+// the number the server accepted and the number it rejected.
+func (this *fileBackend) Sync(ctx context.Context) (int, int, error) {
+	return this.Outbox.Flush(ctx)
+}
+
+// devicePath returns the file in which a device's latest checkin is kept.
+// Devices without a serial number are told apart by their connection, so
+// that identical unserialized devices do not overwrite each other. Serial
+// numbers and connections are reported by the device and may hold path
+// separators or other characters unsafe in file names, so those are
+// replaced.
+func (this *fileBackend) devicePath(dev usb.Reporter) (string) {
+
+	fn := fmt.Sprintf(`%s-%s-%s.json`, dev.VID(), dev.PID(), safeName(dev.SN()))
+
+	if dev.SN() == `` {
+		fn = fmt.Sprintf(`%s-%s@%s.json`, dev.VID(), dev.PID(), safeName(dev.Conn()))
+	}
+
+	return filepath.Join(this.Dir, `devices`, fn)
+}
+
+// safeName replaces each character of s other than letters, digits, dots,
+// underscores, and hyphens with an underscore.
+func safeName(s string) (string) {
+
+	return strings.Map(func(r rune) (rune) {
+
+		switch {
+
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+
+		case r == '.', r == '_', r == '-':
+			return r
+		}
+
+		return '_'
+
+	}, s)
+}
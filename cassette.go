@@ -0,0 +1,215 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`bytes`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`net/http`
+	`os`
+	`path/filepath`
+	`sync`
+)
+
+// Cassette modes.
+const (
+	CassetteRecord = `record`
+	CassetteReplay = `replay`
+)
+
+// Cassette is an http.RoundTripper that stands in for the client transport
+// so that exchanges with the server can be captured once and played back
+// later without the server. In record mode it passes requests to the
+// underlying transport and saves each exchange in the cassette file. In
+// replay mode it answers requests from the file, matching on method, URL,
+// and body; JSON bodies match if they are equivalent. Requests to hosts
+// not in Hosts, if set, are always passed to the underlying transport.
+type Cassette struct {
+	File string
+	Mode string
+	Hosts map[string]bool
+	Transport http.RoundTripper
+	Interactions []*Interaction
+	mu sync.Mutex
+}
+
+// Interaction is a recorded request and its response.
+type Interaction struct {
+	Request struct {
+		Method string
+		URL string
+		Body string
+	}
+	Response struct {
+		StatusCode int
+		Header http.Header
+		Body string
+	}
+	used bool
+}
+
+// newCassette creates a Cassette in the given mode over the given transport,
+// loading the cassette file in replay mode.
+func newCassette(fn, mode string, rt http.RoundTripper) (*Cassette, error) {
+
+	this := &Cassette{File: fn, Mode: mode, Transport: rt}
+
+	switch mode {
+
+	case CassetteRecord:
+		return this, nil
+
+	case CassetteReplay:
+		return this, loadConfig(&this.Interactions, fn)
+
+	default:
+		return nil, fmt.Errorf(`unsupported cassette mode '%s'`, mode)
+	}
+}
+
+// RoundTrip records or replays the exchange.
+func (this *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	if len(this.Hosts) > 0 && !this.Hosts[req.URL.Host] {
+		return this.Transport.RoundTrip(req)
+	}
+
+	var body []byte
+
+	if req.GetBody != nil {
+		if rc, err := req.GetBody(); err != nil {
+			return nil, err
+		} else {
+			body, _ = ioutil.ReadAll(rc)
+			rc.Close()
+		}
+	}
+
+	if this.Mode == CassetteReplay {
+		return this.replay(req, body)
+	}
+
+	return this.record(req, body)
+}
+
+// replay answers the request with the first unused matching interaction,
+// or with the last matching interaction if all have been used.
+func (this *Cassette) replay(req *http.Request, body []byte) (*http.Response, error) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var match *Interaction
+
+	for _, ia := range this.Interactions {
+
+		if !ia.matches(req, body) {
+			continue
+		}
+
+		if match = ia; !ia.used {
+			break
+		}
+	}
+
+	if match == nil {
+		return nil, fmt.Errorf(`cassette %s has no interaction for %s %s`,
+			this.File, req.Method, req.URL,
+		)
+	}
+
+	match.used = true
+
+	return &http.Response{
+		Status: fmt.Sprintf(`%d %s`, match.Response.StatusCode, http.StatusText(match.Response.StatusCode)),
+		StatusCode: match.Response.StatusCode,
+		Proto: `HTTP/1.1`,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: match.Response.Header.Clone(),
+		Body: ioutil.NopCloser(bytes.NewBufferString(match.Response.Body)),
+		ContentLength: int64(len(match.Response.Body)),
+		Request: req,
+	}, nil
+}
+
+// record sends the request with the underlying transport and saves the
+// exchange. Requests that fail without a response are not recorded.
+func (this *Cassette) record(req *http.Request, body []byte) (*http.Response, error) {
+
+	resp, err := this.Transport.RoundTrip(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+
+	ia := new(Interaction)
+	ia.Request.Method = req.Method
+	ia.Request.URL = req.URL.String()
+	ia.Request.Body = string(body)
+	ia.Response.StatusCode = resp.StatusCode
+	ia.Response.Header = resp.Header.Clone()
+	ia.Response.Body = string(b)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.Interactions = append(this.Interactions, ia)
+
+	if serr := this.save(); serr != nil {
+		el.Printf(`cassette %s not saved - %v`, this.File, serr)
+	}
+
+	return resp, nil
+}
+
+// save writes the interactions to the cassette file.
+func (this *Cassette) save() (error) {
+
+	if err := os.MkdirAll(filepath.Dir(this.File), DirMode); err != nil {
+		return err
+	}
+
+	if b, err := json.MarshalIndent(this.Interactions, ``, "\t"); err != nil {
+		return err
+	} else {
+		return ioutil.WriteFile(this.File, b, FileMode)
+	}
+}
+
+// matches returns true if the interaction was recorded for the request.
+func (this *Interaction) matches(req *http.Request, body []byte) (bool) {
+
+	if this.Request.Method != req.Method || this.Request.URL != req.URL.String() {
+		return false
+	}
+
+	if this.Request.Body == string(body) {
+		return true
+	}
+
+	return json.Valid(body) && contentHash([]byte(this.Request.Body)) == contentHash(body)
+}
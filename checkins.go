@@ -0,0 +1,163 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`crypto/sha256`
+	`encoding/hex`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`strings`
+	`github.com/jscherff/cmdb/ci/peripheral/usb`
+)
+
+// CheckinCache records the content hash of the last checkin the server
+// accepted for each device so that unchanged devices need not be checked in
+// again. In conditional mode the hash of the device being checked in is
+// sent to the server as an entity tag, and the server answers 304 Not
+// Modified if it already holds the same content; in local mode unchanged
+// devices are skipped without contacting the server. Batch checkins are
+// always compared locally.
+type CheckinCache struct {
+	File string				// Hash file; blank for no persistence
+	Mode string				// conditional, local, or off
+	hashes map[string]string
+}
+
+// Init validates settings and loads the hash file.
+func (this *CheckinCache) Init() (error) {
+
+	this.hashes = make(map[string]string)
+
+	switch this.Mode {
+
+	case ``:
+		this.Mode = `conditional`
+
+	case `conditional`, `local`, `off`:
+
+	default:
+		return fmt.Errorf(`unsupported checkin cache mode '%s'`, this.Mode)
+	}
+
+	if this.File == `` {
+		return nil
+	}
+
+	this.File = filePath(this.File)
+
+	if _, err := makePath(filepath.Dir(this.File)); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(this.File); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := loadConfig(&this.hashes, this.File); err != nil {
+		el.Printf(`checkin cache %s unreadable, starting empty - %v`, this.File, err)
+		this.hashes = make(map[string]string)
+	}
+
+	return nil
+}
+
+// Unchanged returns true if the device JSON matches that of the last
+// accepted checkin.
+func (this *CheckinCache) Unchanged(dev usb.Reporter, j []byte) (bool) {
+
+	if this.Mode == `off` {
+		return false
+	}
+
+	if h, ok := this.hashes[checkinKey(dev)]; !ok {
+		return false
+	} else {
+		return h == contentHash(j)
+	}
+}
+
+// Tag returns the entity tag of the device JSON being checked in, in
+// conditional mode, or an empty string.
+func (this *CheckinCache) Tag(j []byte) (string) {
+
+	if this.Mode != `conditional` {
+		return ``
+	}
+
+	return `"` + contentHash(j) + `"`
+}
+
+// Accept records the device JSON as that of the last accepted checkin.
+func (this *CheckinCache) Accept(dev usb.Reporter, j []byte) {
+
+	if this.Mode == `off` {
+		return
+	}
+
+	this.hashes[checkinKey(dev)] = contentHash(j)
+
+	if err := this.save(); err != nil {
+		el.Printf(`checkin cache %s not saved - %v`, this.File, err)
+	}
+}
+
+// save writes the hashes to the hash file.
+func (this *CheckinCache) save() (error) {
+
+	if this.File == `` {
+		return nil
+	}
+
+	if b, err := json.Marshal(this.hashes); err != nil {
+		return err
+	} else {
+		return ioutil.WriteFile(this.File, b, FileMode)
+	}
+}
+
+// checkinKey identifies a device in the checkin cache. Devices without
+// serial numbers are identified by their connection instead.
+func checkinKey(dev usb.Reporter) (string) {
+
+	id := dev.SN()
+
+	if id == `` {
+		id = dev.Conn()
+	}
+
+	return strings.Join([]string{dev.VID(), dev.PID(), id}, `-`)
+}
+
+// contentHash returns the SHA-256 hash of the canonical form of a JSON
+// document, in which object members are sorted and whitespace removed,
+// so that equivalent documents have the same hash. Documents that are
+// not valid JSON are hashed as is.
+func contentHash(j []byte) (string) {
+
+	var v interface{}
+
+	if err := json.Unmarshal(j, &v); err == nil {
+		if b, err := json.Marshal(v); err == nil {
+			j = b
+		}
+	}
+
+	sum := sha256.Sum256(j)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,470 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`bytes`
+	`context`
+	`encoding/csv`
+	`encoding/json`
+	`encoding/xml`
+	`fmt`
+	`strings`
+	`github.com/google/gousb`
+	`github.com/jscherff/cmdb/ci/peripheral/usb`
+)
+
+// Classes holds the names of the class, subclass, and protocol of a device
+// or, when the device class is defined per interface, the codes and names
+// of those of each of its interfaces.
+type Classes struct {
+	ClassName string			`json:"usb_class_name,omitempty" xml:"usb_class_name,omitempty"`
+	SubClassName string			`json:"usb_subclass_name,omitempty" xml:"usb_subclass_name,omitempty"`
+	ProtocolName string			`json:"usb_protocol_name,omitempty" xml:"usb_protocol_name,omitempty"`
+	Interfaces []*InterfaceClasses		`json:"usb_interfaces,omitempty" xml:"usb_interfaces>usb_interface,omitempty"`
+}
+
+// InterfaceClasses holds the class, subclass, and protocol codes and names
+// of a device interface.
+type InterfaceClasses struct {
+	Number int				`json:"interface_number" xml:"interface_number"`
+	Class string				`json:"usb_class" xml:"usb_class"`
+	SubClass string				`json:"usb_subclass" xml:"usb_subclass"`
+	Protocol string				`json:"usb_protocol" xml:"usb_protocol"`
+	ClassName string			`json:"usb_class_name,omitempty" xml:"usb_class_name,omitempty"`
+	SubClassName string			`json:"usb_subclass_name,omitempty" xml:"usb_subclass_name,omitempty"`
+	ProtocolName string			`json:"usb_protocol_name,omitempty" xml:"usb_protocol_name,omitempty"`
+}
+
+// descriptor returns the descriptor of a device that has not yet been
+// converted, or nil if it is not available.
+func descriptor(i interface{}) (*gousb.DeviceDesc) {
+
+	switch t := i.(type) {
+
+	case *gousb.Device:
+		return t.Desc
+
+	case *gousb.DeviceDesc:
+		return t
+	}
+
+	return nil
+}
+
+// classify resolves the names of the class, subclass, and protocol in the
+// device descriptor or, if the device class is per-interface, those of each
+// interface in the lowest-numbered configuration.
+func classify(ctx context.Context, desc *gousb.DeviceDesc) (*Classes) {
+
+	if desc == nil {
+		return nil
+	}
+
+	this := new(Classes)
+
+	if desc.Class != gousb.ClassPerInterface {
+
+		this.ClassName, this.SubClassName, this.ProtocolName = classNames(ctx,
+			fmt.Sprintf(`%02x`, uint8(desc.Class)),
+			fmt.Sprintf(`%02x`, uint8(desc.SubClass)),
+			fmt.Sprintf(`%02x`, uint8(desc.Protocol)),
+		)
+
+		return this
+	}
+
+	cn := -1
+
+	for n := range desc.Configs {
+		if cn < 0 || n < cn {
+			cn = n
+		}
+	}
+
+	if cn < 0 {
+		return this
+	}
+
+	for _, id := range desc.Configs[cn].Interfaces {
+
+		if len(id.AltSettings) == 0 {
+			continue
+		}
+
+		as := id.AltSettings[0]
+
+		ic := &InterfaceClasses{
+			Number: id.Number,
+			Class: fmt.Sprintf(`%02x`, uint8(as.Class)),
+			SubClass: fmt.Sprintf(`%02x`, uint8(as.SubClass)),
+			Protocol: fmt.Sprintf(`%02x`, uint8(as.Protocol)),
+		}
+
+		ic.ClassName, ic.SubClassName, ic.ProtocolName = classNames(ctx,
+			ic.Class, ic.SubClass, ic.Protocol,
+		)
+
+		this.Interfaces = append(this.Interfaces, ic)
+	}
+
+	return this
+}
+
+// classNames resolves class, subclass, and protocol codes to names using
+// the local USB ID database and the server. Names that cannot be resolved
+// are left empty.
+func classNames(ctx context.Context, c, s, p string) (cn, sn, pn string) {
+
+	cn, _ = resolve(
+
+		func() (string, bool) {
+			return usbIDs.Class(c)
+		},
+
+		func() (string, error) {
+			return conf.MetaCache.Lookup(`class/` + c, func() (string, error) {
+				return backend.Class(ctx, c)
+			})
+		},
+	)
+
+	sn, _ = resolve(
+
+		func() (string, bool) {
+			return usbIDs.SubClass(c, s)
+		},
+
+		func() (string, error) {
+			return conf.MetaCache.Lookup(`subclass/` + c + `/` + s, func() (string, error) {
+				return backend.SubClass(ctx, c, s)
+			})
+		},
+	)
+
+	pn, _ = resolve(
+
+		func() (string, bool) {
+			return usbIDs.Protocol(c, s, p)
+		},
+
+		func() (string, error) {
+			return conf.MetaCache.Lookup(`protocol/` + c + `/` + s + `/` + p, func() (string, error) {
+				return backend.Protocol(ctx, c, s, p)
+			})
+		},
+	)
+
+	return cn, sn, pn
+}
+
+// classified is a device whose representations, used for checkins and
+// reports, include the names of its classes. In CSV and NVP, which have
+// no nesting, the fields of each interface are flattened into fields
+// named usb_interface_<number>_<field>.
+type classified struct {
+	usb.Auditer
+	classes *Classes
+}
+
+// JSON returns the device JSON with class names added.
+func (this *classified) JSON() ([]byte, error) {
+
+	b, err := this.Auditer.JSON()
+
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := json.Marshal(this.classes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeJSON(b, x), nil
+}
+
+// PrettyJSON returns the indented device JSON with class names added.
+func (this *classified) PrettyJSON() ([]byte, error) {
+
+	b, err := this.Auditer.PrettyJSON()
+
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := json.MarshalIndent(this.classes, ``, "\t")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeJSON(b, x), nil
+}
+
+// mergeJSON appends the members of JSON object x to JSON object b,
+// preserving the order and formatting of the members of b.
+func mergeJSON(b, x []byte) ([]byte) {
+
+	b = bytes.TrimSpace(b)
+	x = bytes.TrimSpace(x)
+
+	if len(x) <= 2 || len(b) < 2 || b[len(b)-1] != '}' {
+		return b
+	}
+
+	head := bytes.TrimRight(b[:len(b)-1], " \t\r\n")
+
+	var m bytes.Buffer
+
+	m.Write(head)
+
+	if len(head) > 1 {
+		m.WriteByte(',')
+	}
+
+	m.Write(x[1:len(x)-1])
+	m.Write(b[len(head):])
+
+	return m.Bytes()
+}
+
+// fields returns the class names as flat name-value pairs, in the order
+// of the JSON members, for the CSV and NVP representations.
+func (this *Classes) fields() ([][2]string) {
+
+	var f [][2]string
+
+	add := func(name, value string) {
+		if value != `` {
+			f = append(f, [2]string{name, value})
+		}
+	}
+
+	add(`usb_class_name`, this.ClassName)
+	add(`usb_subclass_name`, this.SubClassName)
+	add(`usb_protocol_name`, this.ProtocolName)
+
+	for _, ic := range this.Interfaces {
+
+		p := fmt.Sprintf(`usb_interface_%d_`, ic.Number)
+
+		add(p + `usb_class`, ic.Class)
+		add(p + `usb_subclass`, ic.SubClass)
+		add(p + `usb_protocol`, ic.Protocol)
+		add(p + `usb_class_name`, ic.ClassName)
+		add(p + `usb_subclass_name`, ic.SubClassName)
+		add(p + `usb_protocol_name`, ic.ProtocolName)
+	}
+
+	return f
+}
+
+// CSV returns the device CSV with class names added.
+func (this *classified) CSV() ([]byte, error) {
+
+	b, err := this.Auditer.CSV()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeCSV(b, this.classes.fields())
+}
+
+// NVP returns the device name-value pairs with class names added.
+func (this *classified) NVP() ([]byte, error) {
+
+	b, err := this.Auditer.NVP()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeNVP(b, this.classes.fields()), nil
+}
+
+// PrettyXML returns the indented device XML with class names added.
+func (this *classified) PrettyXML() ([]byte, error) {
+
+	b, err := this.Auditer.PrettyXML()
+
+	if err != nil {
+		return nil, err
+	}
+
+	x, err := xml.MarshalIndent(this.classes, ``, xmlIndent(b))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeXML(b, x), nil
+}
+
+// mergeCSV appends fields f to CSV b, as columns when b is a header row
+// followed by a value row, or as rows when b is one name-value pair per
+// row. CSV in any other layout is returned unchanged.
+func mergeCSV(b []byte, f [][2]string) ([]byte, error) {
+
+	if len(f) == 0 {
+		return b, nil
+	}
+
+	r := csv.NewReader(bytes.NewReader(b))
+	r.FieldsPerRecord = -1
+
+	recs, err := r.ReadAll()
+
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := len(recs) > 0
+
+	for _, rec := range recs {
+		pairs = pairs && len(rec) == 2
+	}
+
+	switch {
+
+	case pairs:
+		for _, nv := range f {
+			recs = append(recs, []string{nv[0], nv[1]})
+		}
+
+	case len(recs) == 2 && len(recs[0]) == len(recs[1]):
+		for _, nv := range f {
+			recs[0] = append(recs[0], nv[0])
+			recs[1] = append(recs[1], nv[1])
+		}
+
+	default:
+		return b, nil
+	}
+
+	var m bytes.Buffer
+
+	w := csv.NewWriter(&m)
+	w.UseCRLF = bytes.Contains(b, []byte("\r\n"))
+
+	if err := w.WriteAll(recs); err != nil {
+		return nil, err
+	}
+
+	return m.Bytes(), nil
+}
+
+// mergeNVP appends fields f to name-value pairs b, one per line, using
+// the separator between the name and value of the first line of b.
+func mergeNVP(b []byte, f [][2]string) ([]byte) {
+
+	if len(f) == 0 {
+		return b
+	}
+
+	sep := `:`
+
+	line := string(b)
+
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+
+	if i := strings.IndexAny(line, `:=`); i >= 0 {
+
+		j, k := i, i + 1
+
+		for j > 0 && (line[j-1] == ' ' || line[j-1] == '\t') {
+			j--
+		}
+
+		for k < len(line) && (line[k] == ' ' || line[k] == '\t') {
+			k++
+		}
+
+		sep = line[j:k]
+	}
+
+	eol := "\n"
+
+	if bytes.Contains(b, []byte("\r\n")) {
+		eol = "\r\n"
+	}
+
+	m := bytes.NewBuffer(bytes.TrimRight(b, "\r\n"))
+
+	for _, nv := range f {
+
+		if m.Len() > 0 {
+			m.WriteString(eol)
+		}
+
+		m.WriteString(nv[0] + sep + nv[1])
+	}
+
+	m.WriteString(eol)
+
+	return m.Bytes()
+}
+
+// mergeXML inserts the child elements of XML element x before the closing
+// tag of the root element of XML document b, preserving the formatting of
+// b. Indented elements of x are expected to be indented one level.
+func mergeXML(b, x []byte) ([]byte) {
+
+	b = bytes.TrimRight(b, " \t\r\n")
+	x = bytes.TrimSpace(x)
+
+	i := bytes.LastIndex(b, []byte(`</`))
+	xs := bytes.IndexByte(x, '>')
+	xe := bytes.LastIndex(x, []byte(`</`))
+
+	if i < 0 || xs < 0 || xe <= xs {
+		return b
+	}
+
+	head := bytes.TrimRight(b[:i], " \t")
+	body := bytes.TrimRight(x[xs+1:xe], " \t")
+
+	var m bytes.Buffer
+
+	m.Write(head)
+
+	if bytes.HasSuffix(head, []byte("\n")) {
+		m.Write(bytes.TrimLeft(body, "\r\n"))
+		m.WriteByte('\n')
+	} else {
+		m.Write(bytes.TrimSpace(body))
+	}
+
+	m.Write(b[i:])
+
+	return m.Bytes()
+}
+
+// xmlIndent returns the indentation of the first indented line of XML
+// document b, or a tab if no line is indented.
+func xmlIndent(b []byte) (string) {
+
+	for _, line := range strings.Split(string(b), "\n") {
+		if ws := len(line) - len(strings.TrimLeft(line, " \t")); ws > 0 && ws < len(line) {
+			return line[:ws]
+		}
+	}
+
+	return "\t"
+}
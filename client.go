@@ -16,10 +16,13 @@ package main
 
 import (
 	`bytes`
+	`context`
 	`encoding/json`
 	`fmt`
+	`io`
 	`io/ioutil`
 	`net/http`
+	`time`
 	`github.com/jscherff/cmdb/ci/peripheral/usb`
 )
 
@@ -32,6 +35,7 @@ var authenticated = false
 type httpResult struct {
 	status httpStatus
 	content httpContent
+	header http.Header
 }
 
 // Status returns the status of the http response.
@@ -44,6 +48,11 @@ func (this *httpResult) Content() (httpContent) {
 	return this.content
 }
 
+// Err returns the error the server gave for a rejected request.
+func (this *httpResult) Err() (error) {
+	return newAPIError(this)
+}
+
 // String implements the Stringer interface for httpResult.
 func (this *httpResult) String() (string) {
 	return fmt.Sprintf(`%s: %s`, this.Status(), this.Content())
@@ -72,6 +81,33 @@ func (this httpStatus) Rejected() (bool) {
 	return !this.Accepted()
 }
 
+// Unauthorized returns true if the server refused the request because
+// the client credentials or token were missing, expired, or invalid.
+func (this httpStatus) Unauthorized() (bool) {
+
+	switch int(this) {
+	case http.StatusUnauthorized:
+	case http.StatusForbidden:
+	default: return false
+	}
+
+	return true
+}
+
+// Unsupported returns true if the server does not implement the endpoint
+// or method of the request.
+func (this httpStatus) Unsupported() (bool) {
+
+	switch int(this) {
+	case http.StatusNotFound:
+	case http.StatusMethodNotAllowed:
+	case http.StatusNotImplemented:
+	default: return false
+	}
+
+	return true
+}
+
 // String implements the Stringer interface for httpStatus.
 func (this httpStatus) String() (string) {
 	return this.StatusText()
@@ -100,21 +136,79 @@ func (this httpContent) String() (s string) {
 }
 
 // auth authenticates with the server using basic authentication and, if
-// successful, obtains JWT for API authentication in a cookie.
-func auth() error {
+// successful, obtains JWT for API authentication in a cookie. In OAuth2
+// mode it obtains a bearer token from the identity provider instead.
+// Refused credentials are reported as an authError; a server that cannot
+// be reached or fails with a 5xx error is not a refusal.
+func auth(ctx context.Context) error {
 
 	if authenticated {
 		return nil
 	}
 
-	url := fmt.Sprintf(conf.Server.Endpoints[`cmdb_auth`],
-		conf.Client.HostName,
-	)
+	if conf.Server.Auth.Mode == AuthOAuth2 {
+
+		if _, err := conf.Server.Auth.OAuth2.Token(ctx); err != nil {
+			return err
+		}
+
+		sl.Printf(`authentication success - bearer token`)
+		authenticated = true
+		return nil
+	}
+
+	// Servers that cannot be reached or fail with a 5xx error are failed
+	// over like other requests, and the next server is asked instead.
+
+	servers.Select(ctx)
+
+	hr, err := authRequest(ctx)
+
+	for n := 1; n < servers.Len() && undeliverable(hr, err) && ctx.Err() == nil; n++ {
+
+		if err == nil {
+			err = fmt.Errorf(`%s`, hr.Status())
+		}
+
+		from, to := servers.Current(), servers.Next()
+
+		el.Printf(`server %s unavailable for authentication - %v, failing over to %s`,
+			from.Host(), err, to.Host(),
+		)
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+		if servers.versioned && servers.Info() == nil {
+			if si, err := servers.negotiate(ctx); err != nil {
+				el.Printf(`server %s capabilities unknown, using API %s - %v`, to.Host(), si.API, err)
+			}
+		}
+
+		hr, err = authRequest(ctx)
+	}
 
 	if err != nil {
 		return err
+	} else if undeliverable(hr, nil) {
+		return fmt.Errorf(`authentication not completed - %w`, hr.Err())
+	} else if hr.Status().Rejected() {
+		return &authError{hr.Err()}
+	} else {
+		sl.Printf(`authentication success - %s`, hr.Status())
+	}
+
+	authenticated = true
+	return nil
+}
+
+// authRequest sends the basic authentication credentials to the server in
+// use.
+func authRequest(ctx context.Context) (*httpResult, error) {
+
+	url := endpoint(`cmdb_auth`, conf.Client.HostName)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, err
 	}
 
 	req.SetBasicAuth(
@@ -122,77 +216,263 @@ func auth() error {
 		conf.Server.Auth.Password,
 	)
 
-	if hr, err := httpRequest(req); err != nil {
+	return httpSend(req)
+}
+
+// reauth discards the current session cookie or bearer token and
+// authenticates again to obtain a new one.
+func reauth(ctx context.Context) error {
+
+	if jar, err := newCookieJar(); err != nil {
 		return err
-	} else if hr.Status().Rejected() {
-		return fmt.Errorf(`authentication failure - %s`, hr)
 	} else {
-		sl.Printf(`authentication success - %s`, hr.Status())
+		httpClient.Jar = jar
 	}
 
-	authenticated = true
-	return nil
+	if conf.Server.Auth.Mode == AuthOAuth2 {
+		conf.Server.Auth.OAuth2.Reset()
+	}
+
+	authenticated = false
+	return auth(ctx)
 }
 
 // newSn obtains a serial number from the cmdbd server.
-func newSn(dev usb.Serializer) (string, error) {
+func newSn(ctx context.Context, dev usb.Serializer) (string, error) {
 
-	if err := auth(); err != nil {
+	if err := auth(ctx); err != nil {
 		return ``, err
 	}
 
-	url := fmt.Sprintf(conf.Server.Endpoints[`usb_ci_newsn`],
-		conf.Client.HostName,
-		dev.VID(),
-		dev.PID(),
-	)
+	url := endpoint(`usb_ci_newsn`, conf.Client.HostName, dev.VID(), dev.PID())
 
 	var s string
 
 	if j, err := dev.JSON(); err != nil {
 		return ``, err
-	} else if hr, err := httpPost(url, j); err != nil {
+	} else if hr, err := httpPost(ctx, url, j); err != nil {
 		return ``, err
 	} else if hr.Status().Rejected() {
-		return ``, fmt.Errorf(`serial number not generated - %s`, hr)
+		return ``, fmt.Errorf(`serial number not generated - %w`, hr.Err())
 	} else if err := hr.Content().Decode(&s); err != nil {
 		return ``, err
 	} else {
 		sl.Printf(`serial number '%s' generated - %s`, s, hr.Status())
+		status.Response(hr.Status())
 		return s, nil
 	}
 }
 
 // checkin checks a device in with the cmdbd server.
-func checkin(dev usb.Reporter) (error) {
+func checkin(ctx context.Context, dev usb.Reporter) (error) {
+
+	params := []string{conf.Client.HostName, dev.VID(), dev.PID()}
 
-	if err := auth(); err != nil {
+	j, err := dev.JSON()
+
+	if err != nil {
 		return err
 	}
 
-	url := fmt.Sprintf(conf.Server.Endpoints[`usb_ci_checkin`],
-		conf.Client.HostName,
-		dev.VID(),
-		dev.PID(),
-	)
+	var tag string
 
-	if j, err := dev.JSON(); err != nil {
-		return err
-	} else if hr, err := httpPost(url, j); err != nil {
+	if !*fGlobalForceCheckin {
+
+		if conf.CheckinCache.Mode == `local` && conf.CheckinCache.Unchanged(dev, j) {
+			sl.Printf(`device %s-%s-%s checkin skipped - unchanged since last checkin`,
+				dev.VID(), dev.PID(), dev.SN(),
+			)
+			return nil
+		}
+
+		if servers.Info().Supports(FeatureConditionalCheckin) {
+			tag = conf.CheckinCache.Tag(j)
+		}
+	}
+
+	if err := auth(ctx); authFailure(err) {
 		return err
+	} else if err != nil {
+		return spoolPost(`checkin`, `usb_ci_checkin`, params, j, nil, err)
+	} else if hr, err := httpPostIfNoneMatch(ctx, endpoint(`usb_ci_checkin`, params...), j, tag); undeliverable(hr, err) {
+		return spoolPost(`checkin`, `usb_ci_checkin`, params, j, hr, err)
 	} else if hr.Status().Rejected() {
-		return fmt.Errorf(`checkin not accepted - %s`, hr)
+		return fmt.Errorf(`checkin not accepted - %w`, hr.Err())
 	} else {
+		conf.CheckinCache.Accept(dev, j)
 		sl.Printf(`checkin accepted - %s`, hr.Status())
+		status.Response(hr.Status())
 		return nil
 	}
 }
 
+// batchResult is the outcome of one device in a batch checkin.
+type batchResult struct {
+	VendorID string		`json:"vendor_id"`
+	ProductID string	`json:"product_id"`
+	SerialNum string	`json:"serial_number"`
+	Status int		`json:"status"`
+	Code string		`json:"code"`
+	Message string		`json:"message"`
+}
+
+// checkinBatch checks in a group of devices with the cmdbd server in a
+// single request and returns the outcome for each device. Devices that
+// are unchanged since their last accepted checkin are skipped.
+func checkinBatch(ctx context.Context, devs []usb.Reporter) ([]error) {
+
+	var (
+		send []usb.Reporter
+		idx []int
+	)
+
+	errs := make([]error, len(devs))
+
+	for i, dev := range devs {
+
+		if j, err := dev.JSON(); err == nil && !*fGlobalForceCheckin && conf.CheckinCache.Unchanged(dev, j) {
+			sl.Printf(`device %s-%s-%s checkin skipped - unchanged since last checkin`,
+				dev.VID(), dev.PID(), dev.SN(),
+			)
+			continue
+		}
+
+		send = append(send, dev)
+		idx = append(idx, i)
+	}
+
+	if len(send) == 0 {
+		return errs
+	}
+
+	for k, err := range postBatch(ctx, send) {
+		errs[idx[k]] = err
+	}
+
+	return errs
+}
+
+// postBatch sends a batch checkin and returns the outcome for each device.
+// If the server does not support batch checkins, devices are checked in
+// individually.
+func postBatch(ctx context.Context, devs []usb.Reporter) ([]error) {
+
+	if !servers.Info().Supports(FeatureBatchCheckin) {
+		sl.Printf(`batch checkin not supported by server, checking in individually`)
+		return checkinEach(ctx, devs)
+	}
+
+	errs := make([]error, len(devs))
+	js := make([]json.RawMessage, len(devs))
+
+	for i, dev := range devs {
+		if js[i], errs[i] = dev.JSON(); errs[i] != nil {
+			return checkinEach(ctx, devs)
+		}
+	}
+
+	j, err := json.Marshal(js)
+
+	if err != nil {
+		return checkinEach(ctx, devs)
+	}
+
+	if err = auth(ctx); authFailure(err) {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	} else if err != nil {
+		return spoolEach(devs, js, nil, err)
+	}
+
+	hr, err := httpPost(ctx, endpoint(`usb_ci_checkin_batch`, conf.Client.HostName), j)
+
+	switch {
+
+	case err == nil && hr.Status().Unsupported():
+		sl.Printf(`batch checkin not supported - %s, checking in individually`, hr.Status())
+		return checkinEach(ctx, devs)
+
+	case undeliverable(hr, err):
+		return spoolEach(devs, js, hr, err)
+
+	case hr.Status().Rejected():
+		for i := range errs {
+			errs[i] = fmt.Errorf(`batch checkin not accepted - %w`, hr.Err())
+		}
+		return errs
+	}
+
+	var res []batchResult
+
+	if err := hr.Content().Decode(&res); err != nil || len(res) != len(devs) {
+		if err == nil {
+			err = fmt.Errorf(`%d results for %d devices`, len(res), len(devs))
+		}
+		for i := range errs {
+			errs[i] = fmt.Errorf(`batch checkin result unreadable - %v`, err)
+		}
+		return errs
+	}
+
+	sl.Printf(`batch checkin of %d devices completed - %s`, len(devs), hr.Status())
+
+	for i, dev := range devs {
+
+		r := res[i]
+
+		if r.VendorID != dev.VID() || r.ProductID != dev.PID() || r.SerialNum != dev.SN() {
+			errs[i] = fmt.Errorf(`device %s-%s-%s batch checkin result is for %s-%s-%s`,
+				dev.VID(), dev.PID(), dev.SN(), r.VendorID, r.ProductID, r.SerialNum,
+			)
+		} else if stat := httpStatus(r.Status); stat.Rejected() {
+			errs[i] = fmt.Errorf(`device %s-%s-%s checkin not accepted - %w`,
+				dev.VID(), dev.PID(), dev.SN(), &APIError{Status: stat, Code: r.Code, Message: r.Message},
+			)
+		} else {
+			conf.CheckinCache.Accept(dev, js[i])
+			sl.Printf(`device %s-%s-%s checkin accepted - %s`,
+				dev.VID(), dev.PID(), dev.SN(), stat,
+			)
+		}
+	}
+
+	return errs
+}
+
+// checkinEach checks in a group of devices individually.
+func checkinEach(ctx context.Context, devs []usb.Reporter) ([]error) {
+
+	errs := make([]error, len(devs))
+
+	for i, dev := range devs {
+		errs[i] = checkin(ctx, dev)
+	}
+
+	return errs
+}
+
+// spoolEach queues the individual checkins of a batch the server could not
+// receive so that they can be delivered on a later run.
+func spoolEach(devs []usb.Reporter, js []json.RawMessage, hr *httpResult, err error) ([]error) {
+
+	errs := make([]error, len(devs))
+
+	for i, dev := range devs {
+		errs[i] = spoolPost(`checkin`, `usb_ci_checkin`,
+			[]string{conf.Client.HostName, dev.VID(), dev.PID()}, js[i], hr, err,
+		)
+	}
+
+	return errs
+}
+
 // checkout obtains the JSON representation of a serialized device object
 // from the server using the unique key combination VID+PID+SN.
-func checkout(dev usb.Auditer) ([]byte, error) {
+func checkout(ctx context.Context, dev usb.Auditer) ([]byte, error) {
 
-	if err := auth(); err != nil {
+	if err := auth(ctx); err != nil {
 		return nil, err
 	}
 
@@ -201,62 +481,54 @@ func checkout(dev usb.Auditer) ([]byte, error) {
 		return nil, nil
 	}
 
-	url := fmt.Sprintf(conf.Server.Endpoints[`usb_ci_checkout`],
-		conf.Client.HostName,
-		dev.VID(),
-		dev.PID(),
-		dev.SN(),
-	)
+	url := endpoint(`usb_ci_checkout`, conf.Client.HostName, dev.VID(), dev.PID(), dev.SN())
 
-	if hr, err := httpGet(url); err != nil {
+	if hr, err := httpGet(ctx, url); err != nil {
 		return nil, err
 	} else if hr.Status().Rejected() {
-		return nil, fmt.Errorf(`device not retreived - %s`, hr)
+		return nil, fmt.Errorf(`device not retreived - %w`, hr.Err())
 	} else {
 		sl.Printf(`device retrieved - %s`, hr.Status())
+		status.Response(hr.Status())
 		return hr.Content(), nil
 	}
 }
 
 // sendAudit submits changes from audit to the server in JSON format.
-func sendAudit(dev usb.Auditer) (error) {
+func sendAudit(ctx context.Context, dev usb.Auditer) (error) {
 
-	if err := auth(); err != nil {
-		return err
-	}
-
-	url := fmt.Sprintf(conf.Server.Endpoints[`usb_ci_audit`],
-		conf.Client.HostName,
-		dev.VID(),
-		dev.PID(),
-		dev.SN(),
-	)
+	params := []string{conf.Client.HostName, dev.VID(), dev.PID(), dev.SN()}
 
 	if j, err := json.Marshal(dev.GetChanges()); err != nil {
 		return err
-	} else if hr, err := httpPost(url, j); err != nil {
+	} else if err := auth(ctx); authFailure(err) {
 		return err
+	} else if err != nil {
+		return spoolPost(`audit`, `usb_ci_audit`, params, j, nil, err)
+	} else if hr, err := httpPost(ctx, endpoint(`usb_ci_audit`, params...), j); undeliverable(hr, err) {
+		return spoolPost(`audit`, `usb_ci_audit`, params, j, hr, err)
 	} else if hr.Status().Rejected() {
-		return fmt.Errorf(`audit not accepted - %s`, hr)
+		return fmt.Errorf(`audit not accepted - %w`, hr.Err())
 	} else {
 		sl.Printf(`audit accepted - %s`, hr.Status())
+		status.Response(hr.Status())
 		return nil
 	}
 }
 
 // vendor retrieves the vendor name given the vid.
-func vendor(dev usb.Updater) (string, error) {
+func vendor(ctx context.Context, dev usb.Updater) (string, error) {
 
-	url := fmt.Sprintf(conf.Server.Endpoints[`usb_meta_vendor`],
-		dev.VID(),
-	)
+	url := endpoint(`usb_meta_vendor`, dev.VID())
 
 	var s string
 
-	if hr, err := httpGet(url); err != nil {
+	if hr, err := httpGet(ctx, url); err != nil {
 		return ``, err
+	} else if hr.Status() == http.StatusNotFound {
+		return ``, fmt.Errorf(`vendor lookup failed - %w %s`, errUnknownID, dev.VID())
 	} else if hr.Status().Rejected() {
-		return ``, fmt.Errorf(`vendor lookup failed - %s`, hr)
+		return ``, fmt.Errorf(`vendor lookup failed - %w`, hr.Err())
 	} else if err := hr.Content().Decode(&s); err != nil {
 		return ``, err
 	} else {
@@ -266,19 +538,18 @@ func vendor(dev usb.Updater) (string, error) {
 }
 
 // product retrieves the product name given the vid and pid.
-func product(dev usb.Updater) (string, error) {
+func product(ctx context.Context, dev usb.Updater) (string, error) {
 
-	url := fmt.Sprintf(conf.Server.Endpoints[`usb_meta_product`],
-		dev.VID(),
-		dev.PID(),
-	)
+	url := endpoint(`usb_meta_product`, dev.VID(), dev.PID())
 
 	var s string
 
-	if hr, err := httpGet(url); err != nil {
+	if hr, err := httpGet(ctx, url); err != nil {
 		return ``, err
+	} else if hr.Status() == http.StatusNotFound {
+		return ``, fmt.Errorf(`product lookup failed - %w %s-%s`, errUnknownID, dev.VID(), dev.PID())
 	} else if hr.Status().Rejected() {
-		return ``, fmt.Errorf(`product lookup failed - %s`, hr)
+		return ``, fmt.Errorf(`product lookup failed - %w`, hr.Err())
 	} else if err := hr.Content().Decode(&s); err != nil {
 		return ``, err
 	} else {
@@ -287,10 +558,109 @@ func product(dev usb.Updater) (string, error) {
 	}
 }
 
+// class retrieves the class name given the class code.
+func class(ctx context.Context, c string) (string, error) {
+
+	url := endpoint(`usb_meta_class`, c)
+
+	var s string
+
+	if hr, err := httpGet(ctx, url); err != nil {
+		return ``, err
+	} else if hr.Status() == http.StatusNotFound {
+		return ``, fmt.Errorf(`class lookup failed - %w %s`, errUnknownID, c)
+	} else if hr.Status().Rejected() {
+		return ``, fmt.Errorf(`class lookup failed - %w`, hr.Err())
+	} else if err := hr.Content().Decode(&s); err != nil {
+		return ``, err
+	} else {
+		sl.Printf(`class lookup succeeded - %s`, hr.Status())
+		return s, nil
+	}
+}
+
+// subclass retrieves the subclass name given the class and subclass codes.
+func subclass(ctx context.Context, c, sc string) (string, error) {
+
+	url := endpoint(`usb_meta_subclass`, c, sc)
+
+	var s string
+
+	if hr, err := httpGet(ctx, url); err != nil {
+		return ``, err
+	} else if hr.Status() == http.StatusNotFound {
+		return ``, fmt.Errorf(`subclass lookup failed - %w %s-%s`, errUnknownID, c, sc)
+	} else if hr.Status().Rejected() {
+		return ``, fmt.Errorf(`subclass lookup failed - %w`, hr.Err())
+	} else if err := hr.Content().Decode(&s); err != nil {
+		return ``, err
+	} else {
+		sl.Printf(`subclass lookup succeeded - %s`, hr.Status())
+		return s, nil
+	}
+}
+
+// protocol retrieves the protocol name given the class, subclass, and
+// protocol codes.
+func protocol(ctx context.Context, c, sc, p string) (string, error) {
+
+	url := endpoint(`usb_meta_protocol`, c, sc, p)
+
+	var s string
+
+	if hr, err := httpGet(ctx, url); err != nil {
+		return ``, err
+	} else if hr.Status() == http.StatusNotFound {
+		return ``, fmt.Errorf(`protocol lookup failed - %w %s-%s-%s`, errUnknownID, c, sc, p)
+	} else if hr.Status().Rejected() {
+		return ``, fmt.Errorf(`protocol lookup failed - %w`, hr.Err())
+	} else if err := hr.Content().Decode(&s); err != nil {
+		return ``, err
+	} else {
+		sl.Printf(`protocol lookup succeeded - %s`, hr.Status())
+		return s, nil
+	}
+}
+
+// spoolPost queues a submission the server could not receive so that it
+// can be delivered on a later run, and returns an error describing why.
+// The submission is also queued if the client could not authenticate.
+func spoolPost(desc, key string, params []string, j []byte, hr *httpResult, err error) (error) {
+
+	if err == nil {
+		err = hr.Err()
+	}
+
+	if serr := spool.Put(key, params, j); serr != nil {
+		return fmt.Errorf(`%s not delivered - %w; not spooled - %v`, desc, err, serr)
+	}
+
+	return fmt.Errorf(`%s not delivered, spooled for later delivery - %w`, desc, err)
+}
+
+// undeliverable returns true if a request failed because the server could
+// not be reached or could not process it, as opposed to being rejected.
+func undeliverable(hr *httpResult, err error) (bool) {
+	return err != nil || int(hr.Status()) >= http.StatusInternalServerError
+}
+
+// endpoint returns the URL of the named API endpoint with its parameters
+// on the server currently in use, from the endpoint set of its API version.
+func endpoint(key string, params ...string) (string) {
+
+	args := make([]interface{}, len(params))
+
+	for i, p := range params {
+		args[i] = p
+	}
+
+	return servers.Current().URL() + fmt.Sprintf(servers.Endpoints()[key], args...)
+}
+
 // httpPost sends http POST requests to cmdbd server endpoints for other functions.
-func httpPost(url string, data []byte ) (*httpResult, error) {
+func httpPost(ctx context.Context, url string, data []byte ) (*httpResult, error) {
 
-	if req, err := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(data)); err != nil {
+	if req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(data)); err != nil {
 		return nil, err
 	} else {
 		req.Header.Add(`Content-Type`, `application/json; charset=UTF8`)
@@ -298,34 +668,208 @@ func httpPost(url string, data []byte ) (*httpResult, error) {
 	}
 }
 
+// httpPostIfNoneMatch sends an http POST request that the server may answer
+// with 304 Not Modified if its copy of the content matches the entity tag.
+// No condition is sent if the tag is empty.
+func httpPostIfNoneMatch(ctx context.Context, url string, data []byte, tag string) (*httpResult, error) {
+
+	if req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(data)); err != nil {
+		return nil, err
+	} else {
+		req.Header.Add(`Content-Type`, `application/json; charset=UTF8`)
+		if tag != `` {
+			req.Header.Add(`If-None-Match`, tag)
+		}
+		return httpRequest(req)
+	}
+}
+
 // httpGet sends http GET requests to cmdbd server endpoints for other functions.
-func httpGet(url string) (*httpResult, error) {
+func httpGet(ctx context.Context, url string) (*httpResult, error) {
 
-	if req, err := http.NewRequest(http.MethodGet, url, nil); err != nil {
+	if req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil); err != nil {
 		return nil, err
 	} else {
 		return httpRequest(req)
 	}
 }
 
-// httpRequest sends http requests to cmdbd server endpoints for other functions.
+// httpRequest sends http requests to cmdbd server endpoints for other
+// functions. If the server cannot be reached, or cannot process a request
+// that is safe to repeat, the client fails over to the next configured
+// server, negotiating its API version and authenticating with it first as
+// needed, and replays the request there. As with retries, other requests
+// fail over only if they never reached the server. If the server rejects a
+// request made during an authenticated session, the session is assumed to
+// have expired; the client obtains a new token and replays the request once.
 func httpRequest(req *http.Request) (*httpResult, error) {
 
-	req.Header.Add(`Accept`, `application/json; charset=UTF8`)
-	req.Header.Add(`X-Custom-Header`, `cmdbc`)
+	servers.Select(req.Context())
+
+	session := authenticated
+	hr, err := httpSend(req)
+
+	for n := 1; n < servers.Len() && undeliverable(hr, err) && (idempotent(req) || dialError(err)) && req.Context().Err() == nil; n++ {
+
+		if err == nil {
+			err = fmt.Errorf(`%s`, hr.Status())
+		}
+
+		eps := servers.Endpoints()
+		from, to := servers.Current(), servers.Next()
+
+		el.Printf(`server %s unavailable - %v, failing over to %s`,
+			from.Host(), err, to.Host(),
+		)
+
+		// Tokens are issued and API versions are selected per server.
+
+		authenticated = false
+
+		if req, err = replay(req); err != nil {
+			return nil, err
+		}
+
+		if servers.versioned && servers.Info() == nil {
+			if si, err := servers.negotiate(req.Context()); err != nil {
+				el.Printf(`server %s capabilities unknown, using API %s - %v`, to.Host(), si.API, err)
+			}
+		}
+
+		if session {
+			if err = auth(req.Context()); err != nil {
+				hr = nil
+				continue
+			}
+		}
+
+		rebase(req, eps)
+
+		hr, err = httpSend(req)
+	}
+
+	if err != nil || !authenticated || !hr.Status().Unauthorized() {
+		return hr, err
+	}
+
+	sl.Printf(`API call %s %s not authorized - %s, reauthenticating`,
+		req.Method, req.URL, hr.Status(),
+	)
+
+	if req, err = replay(req); err != nil {
+		return nil, err
+	}
+
+	if err = reauth(req.Context()); err != nil {
+		return nil, err
+	}
+
+	return httpSend(req)
+}
+
+// httpSend sends an http request to the server and reads the response.
+// Failed attempts are resent according to the client retry policy.
+func httpSend(req *http.Request) (*httpResult, error) {
+
+	req.Header.Set(`Accept`, `application/json; charset=UTF8`)
+	req.Header.Set(`X-Custom-Header`, `cmdbc`)
+	req.Header.Set(`X-Run-ID`, runID)
+
+	if id := opID(req.Context()); id != `` {
+		req.Header.Set(`X-Request-ID`, id)
+	} else {
+		req.Header.Set(`X-Request-ID`, runID)
+	}
+
+	if err := authorize(req); err != nil {
+		return nil, err
+	}
+
+	for attempt := 1; ; attempt++ {
+
+		// Each attempt is signed when it is sent, so that its timestamp
+		// stays within the allowed skew however long the retry delay.
+
+		if conf.Server.Signing.Enabled() {
+			if err := conf.Server.Signing.Sign(req, conf.Client.HostName); err != nil {
+				return nil, err
+			}
+		}
+
+		sl.Printf(`API call %s %s`, req.Method, req.URL)
 
-	sl.Printf(`API call %s %s`, req.Method, req.URL)
+		resp, err := httpClient.Do(req)
 
-	resp, err := httpClient.Do(req)
+		if attempt >= conf.Client.Retry.MaxAttempts || req.Context().Err() != nil ||
+			!conf.Client.Retry.Retryable(req, resp, err) {
+
+			if err != nil {
+				return nil, tlsError(req, err)
+			}
+
+			defer resp.Body.Close()
+
+			stat := httpStatus(resp.StatusCode)
+			body, err := ioutil.ReadAll(resp.Body)
+
+			return &httpResult{stat, body, resp.Header}, err
+		}
+
+		delay := conf.Client.Retry.Delay(attempt, resp)
+
+		if err == nil {
+			err = fmt.Errorf(`%s`, httpStatus(resp.StatusCode))
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+
+		sl.Printf(`API call %s %s failed - %v, retry %d of %d in %s`,
+			req.Method, req.URL, err, attempt, conf.Client.Retry.MaxAttempts - 1, delay,
+		)
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+
+		if req, err = replay(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// replay creates a copy of a previously-sent request so that it can be sent
+// again. The body is rebuilt from the original and session cookies added by
+// the cookie jar are dropped so that the jar can supply current ones.
+func replay(req *http.Request) (*http.Request, error) {
+
+	var body io.Reader
+
+	if req.GetBody != nil {
+		if rc, err := req.GetBody(); err != nil {
+			return nil, err
+		} else {
+			body = rc
+		}
+	} else if req.Body != nil && req.Body != http.NoBody {
+		return nil, fmt.Errorf(`request %s %s cannot be replayed`, req.Method, req.URL)
+	}
+
+	r, err := http.NewRequestWithContext(req.Context(), req.Method, req.URL.String(), body)
 
 	if err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
+	r.ContentLength = req.ContentLength
+	r.GetBody = req.GetBody
 
-	stat := httpStatus(resp.StatusCode)
-	body, err := ioutil.ReadAll(resp.Body)
+	for key, vals := range req.Header {
+		if key != `Cookie` {
+			r.Header[key] = append([]string(nil), vals...)
+		}
+	}
 
-	return &httpResult{stat, body}, err
+	return r, nil
 }
@@ -21,6 +21,8 @@ import (
 	`net/http/cookiejar`
 	`path/filepath`
 	`os`
+	`runtime`
+	`strings`
 	`time`
 	`golang.org/x/net/publicsuffix`
 )
@@ -31,6 +33,13 @@ const (
 	DirMode = 0750
 )
 
+// Locations searched for configuration files.
+const (
+	ConfigEnv = `CMDBC_CONFIG`		// Environment variable naming a file
+	ConfigDir = `cmdbc`			// Directory under $XDG_CONFIG_HOME
+	ConfigDirSystem = `/etc/cmdbc`		// System-wide directory
+)
+
 var (
 	// Program name and version.
 
@@ -45,6 +54,10 @@ var (
 	// Configuration aliases.
 
 	sl, cl, el *Logger
+	spool *Spool
+	backend Backend
+	servers *ServerList
+	usbIDs *UsbIDs
 )
 
 // Config holds the application configuration settings. The struct tags
@@ -58,6 +71,8 @@ type Config struct {
 		IdleConnTimeout time.Duration		// Time limit for idle connections
 		ResponseHeaderTimeout time.Duration	// Time limit for response headers
 		MaxResponseHeaderBytes int64		// Size limit for response headers
+		Retry *Retry				// Retry policy for failed requests
+		Proxy *Proxy				// Forward proxy settings
 	}
 
 	Server struct {
@@ -65,21 +80,42 @@ type Config struct {
 		Protocol string				// Protocol for server connections
 		HostName string				// Hostname or IP address of server
 		Port string				// TCP port on which server listens
+		Failover []*ServerAddr			// Alternate servers, in order of use
+		TLS *TLS				// Settings for secure connections
+		Signing *Signing			// Settings for request signing
 
 		Auth struct {
+			Mode string			// basic (default) or oauth2
 			Username string			// Username for client utility
 			Password string			// Password for client utility 
+			CredentialsFile string		// Plain credentials file (mode 0600)
+			EncryptedFile string		// Credentials encrypted with host key
+			OAuth2 *OAuth2			// OAuth2 client credentials settings
 		}
 
 		Endpoints map[string]string		// REST server API endpoints
+		EndpointSets map[string]map[string]string	// Endpoints by newer API version
 	}
 
 	Paths struct {
 		ReportDir string
+		SpoolDir string
+	}
+
+	Backend struct {
+		Type string				// Backend type: rest or file
+		StoreDir string				// Directory for the file backend
 	}
 
 	Syslog *Syslog
 	Loggers *Loggers
+	MetaCache *MetaCache
+	CheckinCache *CheckinCache
+
+	UsbIDs struct {
+		File string				// Local usb.ids database
+		Mode string				// Use as fallback, primary, or off
+	}
 
 	Include struct {
 		VendorID map[string]bool
@@ -90,21 +126,20 @@ type Config struct {
 	DebugLevel int
 }
 
-// newConfig retrieves the settings in the JSON configuration file and
-// populates the fields in the runtime configuration. It also creates
+// newConfig retrieves the settings in the JSON configuration files and
+// populates the fields in the runtime configuration. Files are loaded in
+// order, each overriding the settings present in it. It also creates
 // directories if they do not already exist.
-func newConfig(cf string) (*Config, error) {
+func newConfig(cfs ...string) (*Config, error) {
 
 	this := &Config{}
 
-	if dn := filepath.Dir(cf); dn == `` {
-		cf = filepath.Join(filepath.Dir(os.Args[0]), cf)
-	}
-
 	// Load the configuration.
 
-	if err := loadConfig(this, cf); err != nil {
-		return nil, err
+	for _, cf := range cfs {
+		if err := loadConfig(this, cf); err != nil {
+			return nil, fmt.Errorf(`config %s - %v`, cf, err)
+		}
 	}
 
 	// Configure HTTP client.
@@ -121,24 +156,46 @@ func newConfig(cf string) (*Config, error) {
 		MaxResponseHeaderBytes: this.Client.MaxResponseHeaderBytes,
 	}
 
+	if this.Client.Proxy != nil {
+		if pf, err := this.Client.Proxy.Func(); err != nil {
+			return nil, err
+		} else {
+			httpTransport.Proxy = pf
+		}
+	}
+
+	if this.Server.TLS != nil {
+		if tc, err := this.Server.TLS.Config(); err != nil {
+			return nil, err
+		} else {
+			httpTransport.TLSClientConfig = tc
+		}
+	}
+
 	httpClient = &http.Client{
 		Timeout: this.Client.Timeout * time.Second,
 		Transport: httpTransport,
 	}
 
-	// Prepend protocol, host, and port to endpoints.
+	// Initialize the retry policy.
 
-	for key, path := range this.Server.Endpoints {
-
-		baseUrl := fmt.Sprintf(`%s://%s:%s`,
-			this.Server.Protocol,
-			this.Server.HostName,
-			this.Server.Port,
-		)
+	if this.Client.Retry == nil {
+		this.Client.Retry = &Retry{}
+	}
 
-		this.Server.Endpoints[key] = baseUrl + path
+	if err := this.Client.Retry.Init(); err != nil {
+		return nil, err
 	}
 
+	// Create the list of servers. Endpoint URLs are built from the
+	// server currently in use when each request is made.
+
+	servers = newServerList(&ServerAddr{
+		Protocol: this.Server.Protocol,
+		HostName: this.Server.HostName,
+		Port: this.Server.Port,
+	}, this.Server.Failover)
+
 	// Create and initialize the Syslog object.
 
 	if err := this.Syslog.Init(); err != nil {
@@ -165,6 +222,81 @@ func newConfig(cf string) (*Config, error) {
                 return nil, fmt.Errorf(`missing "error" log config`)
         }
 
+	this.Loggers.SetIDs(runID, ``)
+
+	sl.Printf(`configuration loaded from %s`, strings.Join(cfs, `, `))
+
+	// Resolve client credentials from more secure sources, if present.
+
+	creds := loadCredentials(
+		&Credentials{this.Server.Auth.Username, this.Server.Auth.Password},
+		this.Server.Auth.CredentialsFile,
+		this.Server.Auth.EncryptedFile,
+	)
+
+	this.Server.Auth.Username = creds.Username
+	this.Server.Auth.Password = creds.Password
+
+	if err := this.validateAuth(); err != nil {
+		return nil, err
+	}
+
+	// Load the request signing key.
+
+	if this.Server.Signing == nil {
+		this.Server.Signing = &Signing{}
+	}
+
+	if err := this.Server.Signing.Init(); err != nil {
+		return nil, err
+	}
+
+	// Load the metadata cache.
+
+	if this.MetaCache == nil {
+		this.MetaCache = &MetaCache{}
+	}
+
+	if err := this.MetaCache.Init(); err != nil {
+		return nil, err
+	}
+
+	// Load the checkin cache.
+
+	if this.CheckinCache == nil {
+		this.CheckinCache = &CheckinCache{}
+	}
+
+	if err := this.CheckinCache.Init(); err != nil {
+		return nil, err
+	}
+
+	// Load the local USB ID database.
+
+	switch this.UsbIDs.Mode {
+
+	case ``, `fallback`, `primary`:
+
+		if this.UsbIDs.File == `` {
+			break
+		}
+
+		this.UsbIDs.File = filePath(this.UsbIDs.File)
+
+		if ids, err := loadUsbIDs(this.UsbIDs.File); os.IsNotExist(err) {
+			sl.Printf(`USB ID database %s not found`, this.UsbIDs.File)
+		} else if err != nil {
+			el.Printf(`USB ID database %s not loaded - %v`, this.UsbIDs.File, err)
+		} else {
+			usbIDs = ids
+		}
+
+	case `off`:
+
+	default:
+		return nil, fmt.Errorf(`unsupported USB ID database mode '%s'`, this.UsbIDs.Mode)
+	}
+
 	// Create report directory.
 
 	if dn, err := makePath(this.Paths.ReportDir); err != nil {
@@ -173,9 +305,34 @@ func newConfig(cf string) (*Config, error) {
 		this.Paths.ReportDir = dn
 	}
 
+	// Create spool directory for undelivered submissions.
+
+	if dn, err := makePath(this.Paths.SpoolDir); err != nil {
+		return nil, err
+	} else {
+		this.Paths.SpoolDir = dn
+		spool = &Spool{Dir: dn}
+	}
+
+	// Create the device information backend.
+
+	if this.Backend.Type == `file` {
+		if dn, err := makePath(this.Backend.StoreDir); err != nil {
+			return nil, err
+		} else {
+			this.Backend.StoreDir = dn
+		}
+	}
+
+	if be, err := newBackend(this.Backend.Type, this.Backend.StoreDir); err != nil {
+		return nil, err
+	} else {
+		backend = be
+	}
+
 	// Create http client cookie jar.
 
-	if jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List}); err != nil {
+	if jar, err := newCookieJar(); err != nil {
 		return nil, err
 	} else {
 		httpClient.Jar = jar
@@ -184,6 +341,11 @@ func newConfig(cf string) (*Config, error) {
 	return this, nil
 }
 
+// newCookieJar creates an empty cookie jar for the http client.
+func newCookieJar() (http.CookieJar, error) {
+	return cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+}
+
 // loadConfig loads a JSON configuration file into an object.
 func loadConfig(t interface{}, cf string) error {
 
@@ -197,10 +359,69 @@ func loadConfig(t interface{}, cf string) error {
 	}
 }
 
+// configFiles returns the configuration files to load, in order of
+// increasing precedence: the file in the program directory, /etc/cmdbc,
+// and $XDG_CONFIG_HOME/cmdbc, if present, then the file named by the
+// CMDBC_CONFIG environment variable and the file given by the -config
+// flag, which must exist.
+func configFiles(name, file string) ([]string, error) {
+
+	var cfs, dirs []string
+
+	dirs = append(dirs, filepath.Dir(os.Args[0]))
+
+	if runtime.GOOS != `windows` {
+		dirs = append(dirs, ConfigDirSystem)
+	}
+
+	if dn := os.Getenv(`XDG_CONFIG_HOME`); dn != `` {
+		dirs = append(dirs, filepath.Join(dn, ConfigDir))
+	} else if dn := os.Getenv(`HOME`); dn != `` {
+		dirs = append(dirs, filepath.Join(dn, `.config`, ConfigDir))
+	}
+
+	for _, dn := range dirs {
+
+		cf := filepath.Join(dn, name)
+
+		if _, err := os.Stat(cf); err == nil {
+			cfs = append(cfs, cf)
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	for _, cf := range []string{os.Getenv(ConfigEnv), file} {
+
+		if cf == `` {
+			continue
+		}
+
+		if _, err := os.Stat(cf); err != nil {
+			return nil, err
+		}
+
+		cfs = append(cfs, cf)
+	}
+
+	if len(cfs) == 0 {
+		return nil, fmt.Errorf(`no %s found in %s`, name, strings.Join(dirs, `, `))
+	}
+
+	return cfs, nil
+}
+
 // makePath creates a directory and all intermediate path components.
 // It prepends the program path if the given path is relative and 
 // returns the resulting absolute path.
 func makePath(path string) (string, error) {
+	path = filePath(path)
+	return path, os.MkdirAll(path, DirMode)
+}
+
+// filePath prepends the program path if the given path is relative and
+// returns the resulting absolute path.
+func filePath(path string) (string) {
 
 	path = filepath.Clean(path)
 
@@ -208,10 +429,50 @@ func makePath(path string) (string, error) {
 		path = filepath.Join(filepath.Dir(os.Args[0]), path)
 	}
 
-	return path, os.MkdirAll(path, DirMode)
+	return path
 }
 
 // displayVersion displays the program version.
 func displayVersion() {
         fmt.Fprintf(os.Stderr, "%s version %s\n", program, version)
 }
+
+// validateAuth selects the authentication mode and checks its settings.
+// The OAuth2 client ID defaults to the resolved username. The client
+// secret is never taken from the basic auth password, which would
+// disclose that password to the identity provider.
+func (this *Config) validateAuth() (error) {
+
+	switch this.Server.Auth.Mode {
+
+	case ``:
+		this.Server.Auth.Mode = AuthBasic
+
+	case AuthBasic:
+
+	case AuthOAuth2:
+
+		oa := this.Server.Auth.OAuth2
+
+		if oa == nil || oa.TokenURL == `` {
+			return fmt.Errorf(`oauth2 authentication requires a token URL`)
+		}
+
+		if oa.ClientID == `` {
+			oa.ClientID = this.Server.Auth.Username
+		}
+
+		if s := os.Getenv(EnvClientSecret); s != `` {
+			oa.ClientSecret = s
+		}
+
+		if oa.ClientSecret == `` {
+			return fmt.Errorf(`oauth2 authentication requires a client secret`)
+		}
+
+	default:
+		return fmt.Errorf(`unsupported authentication mode '%s'`, this.Server.Auth.Mode)
+	}
+
+	return nil
+}
@@ -0,0 +1,308 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`bufio`
+	`crypto/aes`
+	`crypto/cipher`
+	`crypto/rand`
+	`crypto/sha256`
+	`encoding/json`
+	`fmt`
+	`io`
+	`io/ioutil`
+	`os`
+	`runtime`
+	`strings`
+	`golang.org/x/term`
+)
+
+const (
+	CredFileMode = 0600
+	EnvUsername = `CMDBC_USERNAME`
+	EnvPassword = `CMDBC_PASSWORD`
+)
+
+// credKeyLabel distinguishes the host key for credentials from other keys
+// derived from the same host identity. It does not depend on the name of
+// the executable, so that renaming it does not orphan saved credentials.
+const credKeyLabel = `cmdbc credentials`
+
+// Credentials are the username and password the client uses to
+// authenticate with the server.
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// sealedCredentials is the on-disk form of credentials encrypted with
+// a key bound to the host.
+type sealedCredentials struct {
+	Nonce []byte
+	Data []byte
+}
+
+// loadCredentials resolves the client credentials from, in order of
+// precedence, environment variables, the encrypted credentials file, the
+// plain credentials file, and the given credentials from the configuration
+// file. Sources that are absent are skipped; sources that cannot be used
+// are logged and skipped.
+func loadCredentials(creds *Credentials, cf, ef string) (*Credentials) {
+
+	if cf != `` {
+		if c, err := readCredentials(filePath(cf)); err != nil {
+			el.Print(err)
+		} else if c != nil {
+			creds.merge(c)
+		}
+	}
+
+	if ef != `` {
+		if c, err := openCredentials(filePath(ef)); err != nil {
+			el.Print(err)
+		} else if c != nil {
+			creds.merge(c)
+		}
+	}
+
+	creds.merge(&Credentials{
+		Username: os.Getenv(EnvUsername),
+		Password: os.Getenv(EnvPassword),
+	})
+
+	return creds
+}
+
+// merge overrides the credentials with the non-empty fields of another set.
+func (this *Credentials) merge(c *Credentials) {
+
+	if c.Username != `` {
+		this.Username = c.Username
+	}
+	if c.Password != `` {
+		this.Password = c.Password
+	}
+}
+
+// readCredentials reads credentials from a plain JSON file. The file is
+// refused if it can be read by anyone other than its owner. It returns
+// nil credentials if the file does not exist.
+func readCredentials(fn string) (*Credentials, error) {
+
+	fi, err := os.Stat(fn)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := checkPrivate(`credentials file`, fn, fi); err != nil {
+		return nil, err
+	}
+
+	creds := &Credentials{}
+
+	if err := loadConfig(creds, fn); err != nil {
+		return nil, fmt.Errorf(`credentials file %s unreadable - %v`, fn, err)
+	}
+
+	return creds, nil
+}
+
+// checkPrivate returns an error if a file holding secrets can be read by
+// anyone other than its owner. The description names the file in the error.
+func checkPrivate(desc, fn string, fi os.FileInfo) (error) {
+
+	// Windows does not report meaningful permission bits; access to the
+	// file must be restricted with an ACL instead.
+
+	if runtime.GOOS != `windows` && fi.Mode().Perm() &^ CredFileMode != 0 {
+		return fmt.Errorf(`%s %s refused - permissions %#o wider than %#o`,
+			desc, fn, fi.Mode().Perm(), CredFileMode,
+		)
+	}
+
+	return nil
+}
+
+// openCredentials reads and decrypts credentials sealed with the host key.
+// It returns nil credentials if the file does not exist.
+func openCredentials(fn string) (*Credentials, error) {
+
+	sc := &sealedCredentials{}
+
+	if _, err := os.Stat(fn); os.IsNotExist(err) {
+		return nil, nil
+	} else if err := loadConfig(sc, fn); err != nil {
+		return nil, fmt.Errorf(`encrypted credentials file %s unreadable - %v`, fn, err)
+	}
+
+	aead, err := hostCipher()
+
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := aead.Open(nil, sc.Nonce, sc.Data, nil)
+
+	if err != nil {
+		return nil, fmt.Errorf(`encrypted credentials file %s cannot be decrypted on this host`, fn)
+	}
+
+	creds := &Credentials{}
+	return creds, json.Unmarshal(b, creds)
+}
+
+// sealCredentials encrypts credentials with the host key and writes them
+// to a file readable only by its owner.
+func sealCredentials(fn string, creds *Credentials) (error) {
+
+	aead, err := hostCipher()
+
+	if err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(creds)
+
+	if err != nil {
+		return err
+	}
+
+	sc := &sealedCredentials{Nonce: make([]byte, aead.NonceSize())}
+
+	if _, err := io.ReadFull(rand.Reader, sc.Nonce); err != nil {
+		return err
+	}
+
+	sc.Data = aead.Seal(nil, sc.Nonce, b, nil)
+
+	if b, err = json.MarshalIndent(sc, ``, "\t"); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(fn, b, CredFileMode)
+}
+
+// setCredentials encrypts the credentials given on the command line and
+// saves them to the encrypted credentials file. The password is read from
+// standard input if not provided as an option.
+func setCredentials(ef string) (error) {
+
+	if ef == `` {
+		return fmt.Errorf(`no encrypted credentials file configured`)
+	}
+
+	creds := &Credentials{Username: *fCredUsername, Password: *fCredPassword}
+
+	if creds.Username == `` {
+		creds.Username = conf.Server.Auth.Username
+	}
+
+	if creds.Password == `` {
+
+		if pw, err := readPassword(fmt.Sprintf(`Password for %s: `, creds.Username)); err != nil {
+			return err
+		} else {
+			creds.Password = pw
+		}
+	}
+
+	if creds.Username == `` || creds.Password == `` {
+		return fmt.Errorf(`username and password are both required`)
+	}
+
+	if err := sealCredentials(filePath(ef), creds); err != nil {
+		return err
+	}
+
+	sl.Printf(`credentials for %s saved to %s`, creds.Username, filePath(ef))
+	return nil
+}
+
+// readPassword prompts for a password on standard error and reads it from
+// standard input without echoing it, if standard input is a terminal.
+func readPassword(prompt string) (string, error) {
+
+	fmt.Fprint(os.Stderr, prompt)
+
+	fd := int(os.Stdin.Fd())
+
+	if term.IsTerminal(fd) {
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+
+	if line, err := bufio.NewReader(os.Stdin).ReadString('\n'); err != nil && line == `` {
+		return ``, err
+	} else {
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+}
+
+// redactArgs returns a copy of the command-line arguments with the value
+// of the password option replaced, so that the arguments can be logged.
+func redactArgs(args []string) ([]string) {
+
+	out := make([]string, len(args))
+	copy(out, args)
+
+	for i, arg := range out {
+
+		name := strings.TrimLeft(arg, `-`)
+
+		if name == arg {
+			continue
+		}
+
+		if name == `password` && i + 1 < len(out) {
+			out[i + 1] = `REDACTED`
+		} else if strings.HasPrefix(name, `password=`) {
+			out[i] = arg[:len(arg) - len(name)] + `password=REDACTED`
+		}
+	}
+
+	return out
+}
+
+// hostCipher returns an authenticated cipher keyed to this host, so that
+// encrypted credentials copied to another host cannot be decrypted. It
+// fails if the host has no machine ID, rather than deriving a weaker key
+// from the host name alone.
+func hostCipher() (cipher.AEAD, error) {
+
+	hn, err := os.Hostname()
+
+	if err != nil {
+		return nil, err
+	}
+
+	id := machineID()
+
+	if id == `` {
+		return nil, fmt.Errorf(`host key unavailable - no machine ID on this host`)
+	}
+
+	key := sha256.Sum256([]byte(credKeyLabel + "\x00" + id + "\x00" + hn))
+
+	if block, err := aes.NewCipher(key[:]); err != nil {
+		return nil, err
+	} else {
+		return cipher.NewGCM(block)
+	}
+}
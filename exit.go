@@ -0,0 +1,185 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`errors`
+	`io`
+)
+
+// Process exit codes.
+const (
+	ExitSuccess = 0		// all devices processed
+	ExitFailure = 1		// no devices processed, or a fatal error
+	ExitConfig = 2		// invalid flags or configuration
+	ExitPartial = 3		// some devices not processed
+	ExitAuth = 4		// no devices processed, authentication failed
+	ExitNoDevices = 5	// no matching devices found
+	ExitChanges = 6		// all devices processed, audit detected changes
+)
+
+// runStatus aggregates the outcomes of the devices processed in a run.
+// If Output is set, the result for each device and a summary of the run
+// are written to Writer in that format.
+type runStatus struct {
+	Devices int
+	Failed int
+	Skipped int
+	AuthFailed int
+	Changed int
+	Output string
+	Writer io.Writer
+	Results []*DeviceResult
+	current *DeviceResult
+	ended bool
+	exit int
+	err string
+}
+
+// status holds the outcomes of the devices processed in the current run.
+var status runStatus
+
+// Record adds the outcome of a device.
+func (this *runStatus) Record(res *DeviceResult, err error) {
+
+	this.Devices++
+	res.Outcome = OutcomeSuccess
+
+	if err != nil {
+
+		this.Failed++
+		res.Outcome, res.Error = OutcomeFailure, err.Error()
+
+		if authFailure(err) {
+			this.AuthFailed++
+		}
+
+		var ae *APIError
+
+		if errors.As(err, &ae) {
+			res.ServerStatus = int(ae.Status)
+		}
+	}
+
+	this.finish(res)
+}
+
+// Skip adds a device that was not processed because the run was cancelled.
+func (this *runStatus) Skip(res *DeviceResult, err error) {
+
+	this.Devices++
+	this.Skipped++
+
+	res.Outcome, res.Error = OutcomeSkipped, err.Error()
+
+	this.finish(res)
+}
+
+// Changes notes the changes an audit detected on the current device.
+func (this *runStatus) Changes(ch [][]string) {
+
+	this.Changed++
+
+	if this.current != nil {
+		this.current.Changes = ch
+	}
+}
+
+// End ends a run that does not process devices with the given exit code
+// and the error that ended it, if any.
+func (this *runStatus) End(code int, err error) {
+
+	this.ended, this.exit = true, code
+
+	if err != nil {
+		this.err = err.Error()
+	}
+}
+
+// Code returns the exit code for the run. Skipped devices count as failed.
+// When every device failed, the run is reported as an authentication
+// failure if any device failed for that reason.
+func (this *runStatus) Code() (int) {
+
+	if this.ended {
+		return this.exit
+	}
+
+	failed := this.Failed + this.Skipped
+
+	switch {
+
+	case this.Devices == 0:
+		return ExitNoDevices
+
+	case failed == this.Devices && this.AuthFailed > 0:
+		return ExitAuth
+
+	case failed == this.Devices:
+		return ExitFailure
+
+	case failed > 0:
+		return ExitPartial
+
+	case this.Changed > 0:
+		return ExitChanges
+	}
+
+	return ExitSuccess
+}
+
+// authError indicates that the client could not authenticate with the
+// server.
+type authError struct {
+	err error
+}
+
+// Error implements the error interface for authError.
+func (this *authError) Error() (string) {
+	return `authentication failure - ` + this.err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (this *authError) Unwrap() (error) {
+	return this.err
+}
+
+// authFailure returns true if err, or any error it wraps, is a failure
+// to authenticate or a request the server refused as unauthorized.
+func authFailure(err error) (bool) {
+
+	var (
+		ae *authError
+		re *APIError
+	)
+
+	return errors.As(err, &ae) || (errors.As(err, &re) && re.Status.Unauthorized())
+}
+
+// errorCode returns the exit code for an error that ends a run: ExitAuth if
+// the credentials were refused and ExitFailure otherwise.
+func errorCode(err error) (int) {
+
+	switch {
+
+	case err == nil:
+		return ExitSuccess
+
+	case authFailure(err):
+		return ExitAuth
+	}
+
+	return ExitFailure
+}
@@ -0,0 +1,501 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`context`
+	`crypto/hmac`
+	`crypto/rand`
+	`crypto/sha256`
+	`crypto/subtle`
+	`encoding/base64`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`net/http`
+	`os`
+	`path/filepath`
+	`regexp`
+	`strings`
+	`sync`
+	`time`
+)
+
+// FakeTokenCookie is the name of the cookie carrying the JWT issued by the
+// fake server.
+const FakeTokenCookie = `Auth-Token`
+
+// FakeServer is a stand-in for the cmdbd server that implements the API
+// endpoints in the configuration. Clients authenticate with basic auth on
+// the cmdb_auth endpoint and receive a JWT in a cookie, which is required
+// on every other endpoint except cmdb_health, cmdb_info, and the metadata
+// lookups, which cmdbd also serves without authentication. Devices, audits,
+// and issued serial numbers are kept in memory and, if StoreFile is set,
+// saved to and loaded from that file. Metadata lookups are answered from
+// the USB ID database, if one is loaded. If SigningKeys is set, protected
+// requests must be signed with the key of the client host. Rejected
+// requests are answered with a structured APIError body.
+type FakeServer struct {
+	Username string
+	Password string
+	StoreFile string
+	IDs *UsbIDs
+	SigningKeys map[string][]byte
+	MaxSkew time.Duration
+	routes []*fakeRoute
+	key []byte
+	mu sync.Mutex
+	store fakeStore
+}
+
+// fakeStore is the data kept by the fake server.
+type fakeStore struct {
+	Devices map[string]json.RawMessage
+	Audits map[string][]json.RawMessage
+	Serial int
+}
+
+// fakeRoute matches request paths against an endpoint path template.
+type fakeRoute struct {
+	key string
+	re *regexp.Regexp
+}
+
+// newFakeServer creates a fake server for the given endpoints that accepts
+// the given credentials.
+func newFakeServer(endpoints map[string]string, username, password, storeFile string) (*FakeServer, error) {
+
+	this := &FakeServer{
+		Username: username,
+		Password: password,
+		StoreFile: storeFile,
+		key: make([]byte, 32),
+		store: fakeStore{
+			Devices: make(map[string]json.RawMessage),
+			Audits: make(map[string][]json.RawMessage),
+		},
+	}
+
+	if _, err := rand.Read(this.key); err != nil {
+		return nil, err
+	}
+
+	for key, path := range endpoints {
+
+		parts := strings.Split(path, `%s`)
+
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+
+		re, err := regexp.Compile(`^` + strings.Join(parts, `([^/]+)`) + `$`)
+
+		if err != nil {
+			return nil, err
+		}
+
+		this.routes = append(this.routes, &fakeRoute{key, re})
+	}
+
+	if storeFile == `` {
+		return this, nil
+	}
+
+	if _, err := os.Stat(storeFile); os.IsNotExist(err) {
+		return this, nil
+	}
+
+	return this, loadConfig(&this.store, storeFile)
+}
+
+// ServeHTTP routes the request to the handler for its endpoint.
+func (this *FakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	sl.Printf(`fake server %s %s`, r.Method, r.URL.Path)
+
+	for _, rt := range this.routes {
+
+		m := rt.re.FindStringSubmatch(r.URL.Path)
+
+		if m == nil {
+			continue
+		}
+
+		switch rt.key {
+
+		case `cmdb_auth`:
+			this.authenticate(w, r)
+			return
+
+		case `cmdb_health`:
+			this.reply(w, http.StatusOK, `OK`)
+			return
+
+		case `cmdb_info`:
+			this.reply(w, http.StatusOK, &ServerInfo{
+				Version: `fake-` + version,
+				APIVersions: []string{DefaultAPI},
+				Features: []string{FeatureBatchCheckin, FeatureConditionalCheckin},
+			})
+			return
+
+		case `usb_meta_vendor`, `usb_meta_product`, `usb_meta_class`, `usb_meta_subclass`, `usb_meta_protocol`:
+			this.handle(rt.key, m[1:], w, r)
+			return
+		}
+
+		if !this.authorized(r) {
+			this.fail(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, `not authenticated`)
+			return
+		}
+
+		if len(this.SigningKeys) > 0 {
+
+			keys := func(id string) ([]byte, bool) {
+				key, ok := this.SigningKeys[id]
+				return key, ok
+			}
+
+			if err := verifySignature(r, keys, this.MaxSkew); err != nil {
+				this.fail(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, err.Error())
+				return
+			}
+		}
+
+		this.handle(rt.key, m[1:], w, r)
+		return
+	}
+
+	this.fail(w, r, http.StatusNotFound, ErrCodeNotFound, `no such endpoint`)
+}
+
+// handle serves an authorized request for an endpoint.
+func (this *FakeServer) handle(key string, args []string, w http.ResponseWriter, r *http.Request) {
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var body []byte
+
+	if r.Method == http.MethodPost {
+
+		var err error
+
+		if body, err = ioutil.ReadAll(r.Body); err != nil || !json.Valid(body) {
+			this.fail(w, r, http.StatusBadRequest, ErrCodeInvalidJSON, `invalid JSON`)
+			return
+		}
+	}
+
+	switch key {
+
+	case `usb_ci_checkin`:
+		this.checkin(w, r, body)
+
+	case `usb_ci_checkin_batch`:
+		this.checkinBatch(w, r, body)
+
+	case `usb_ci_checkout`:
+		if j, ok := this.store.Devices[strings.Join(args[1:], `-`)]; ok {
+			w.Header().Set(`Content-Type`, `application/json`)
+			w.Write(j)
+		} else {
+			this.fail(w, r, http.StatusNotFound, ErrCodeNotFound, `device not found`)
+		}
+
+	case `usb_ci_newsn`:
+		this.newSn(w, r, body)
+
+	case `usb_ci_audit`:
+		id := strings.Join(args[1:], `-`)
+		this.store.Audits[id] = append(this.store.Audits[id], body)
+		this.save()
+		this.reply(w, http.StatusCreated, `audit recorded`)
+
+	case `usb_meta_vendor`, `usb_meta_product`, `usb_meta_class`, `usb_meta_subclass`, `usb_meta_protocol`:
+		if s, ok := this.lookup(key, args); ok {
+			this.reply(w, http.StatusOK, s)
+		} else {
+			this.fail(w, r, http.StatusNotFound, ErrCodeNotFound, `unknown ID`)
+		}
+
+	default:
+		this.fail(w, r, http.StatusNotImplemented, ErrCodeNotImplemented, `endpoint not implemented`)
+	}
+}
+
+// checkin stores a device. If the If-None-Match header holds the entity
+// tag of the stored device, 304 Not Modified is returned without storing
+// the request, as the client is expected to send the tag of its body.
+func (this *FakeServer) checkin(w http.ResponseWriter, r *http.Request, body []byte) {
+
+	id, err := fakeDeviceID(body)
+
+	if err != nil {
+		this.fail(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+		return
+	}
+
+	if old, ok := this.store.Devices[id]; ok && r.Header.Get(`If-None-Match`) == `"` + contentHash(old) + `"` {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	this.store.Devices[id] = body
+	this.save()
+
+	w.Header().Set(`ETag`, `"` + contentHash(body) + `"`)
+	this.reply(w, http.StatusCreated, `device checked in`)
+}
+
+// newSn issues a serial number to a device. Devices whose serial number
+// is already registered are refused with ErrCodeDuplicateSerial.
+func (this *FakeServer) newSn(w http.ResponseWriter, r *http.Request, body []byte) {
+
+	id, err := fakeDeviceID(body)
+
+	if err != nil {
+		this.fail(w, r, http.StatusBadRequest, ErrCodeBadRequest, err.Error())
+		return
+	}
+
+	if _, ok := this.store.Devices[id]; ok && !strings.HasSuffix(id, `-`) {
+		this.fail(w, r, http.StatusConflict, ErrCodeDuplicateSerial, `duplicate serial number`,
+			FieldError{`serial_number`, `already registered to device ` + id},
+		)
+		return
+	}
+
+	this.store.Serial++
+	this.save()
+	this.reply(w, http.StatusCreated, fmt.Sprintf(`FAKE%06d`, this.store.Serial))
+}
+
+// checkinBatch stores a list of devices and returns the outcome for each.
+func (this *FakeServer) checkinBatch(w http.ResponseWriter, r *http.Request, body []byte) {
+
+	var devs []json.RawMessage
+
+	if err := json.Unmarshal(body, &devs); err != nil {
+		this.fail(w, r, http.StatusBadRequest, ErrCodeInvalidJSON, `invalid batch`)
+		return
+	}
+
+	res := make([]batchResult, len(devs))
+
+	for i, j := range devs {
+
+		json.Unmarshal(j, &res[i])
+		res[i].Status, res[i].Message = http.StatusCreated, `device checked in`
+
+		if id, err := fakeDeviceID(j); err != nil {
+			res[i].Status, res[i].Code, res[i].Message = http.StatusBadRequest, ErrCodeBadRequest, err.Error()
+		} else {
+			this.store.Devices[id] = j
+		}
+	}
+
+	this.save()
+	this.reply(w, http.StatusOK, res)
+}
+
+// lookup resolves a metadata request using the USB ID database.
+func (this *FakeServer) lookup(key string, args []string) (string, bool) {
+
+	if this.IDs == nil {
+		return ``, false
+	}
+
+	switch key {
+
+	case `usb_meta_vendor`:
+		return this.IDs.Vendor(args[0])
+
+	case `usb_meta_product`:
+		return this.IDs.Product(args[0], args[1])
+
+	case `usb_meta_class`:
+		return this.IDs.Class(args[0])
+
+	case `usb_meta_subclass`:
+		return this.IDs.SubClass(args[0], args[1])
+
+	default:
+		return this.IDs.Protocol(args[0], args[1], args[2])
+	}
+}
+
+// authenticate checks basic auth credentials and issues a JWT cookie.
+func (this *FakeServer) authenticate(w http.ResponseWriter, r *http.Request) {
+
+	user, pass, ok := r.BasicAuth()
+
+	if !ok || subtle.ConstantTimeCompare([]byte(user), []byte(this.Username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(pass), []byte(this.Password)) != 1 {
+
+		this.fail(w, r, http.StatusUnauthorized, ErrCodeUnauthorized, `invalid credentials`)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name: FakeTokenCookie,
+		Value: this.token(user, time.Now().Add(time.Hour)),
+		Path: `/`,
+		HttpOnly: true,
+	})
+
+	this.reply(w, http.StatusOK, `authenticated`)
+}
+
+// authorized returns true if the request carries a valid, unexpired JWT.
+func (this *FakeServer) authorized(r *http.Request) (bool) {
+
+	c, err := r.Cookie(FakeTokenCookie)
+
+	if err != nil {
+		return false
+	}
+
+	parts := strings.Split(c.Value, `.`)
+
+	if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(this.sign(parts[0] + `.` + parts[1]))) {
+		return false
+	}
+
+	var claims struct{ Exp int64 `json:"exp"` }
+
+	if b, err := base64.RawURLEncoding.DecodeString(parts[1]); err != nil {
+		return false
+	} else if err := json.Unmarshal(b, &claims); err != nil {
+		return false
+	}
+
+	return time.Now().Unix() < claims.Exp
+}
+
+// token issues an HS256 JWT for the user.
+func (this *FakeServer) token(user string, exp time.Time) (string) {
+
+	enc := base64.RawURLEncoding
+
+	head := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	claims, _ := json.Marshal(map[string]interface{}{
+		`sub`: user,
+		`iat`: time.Now().Unix(),
+		`exp`: exp.Unix(),
+	})
+
+	s := head + `.` + enc.EncodeToString(claims)
+	return s + `.` + this.sign(s)
+}
+
+// sign returns the HS256 signature of a JWT header and payload.
+func (this *FakeServer) sign(s string) (string) {
+
+	mac := hmac.New(sha256.New, this.key)
+	mac.Write([]byte(s))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// reply writes a JSON response.
+func (this *FakeServer) reply(w http.ResponseWriter, code int, v interface{}) {
+
+	w.Header().Set(`Content-Type`, `application/json`)
+	w.WriteHeader(code)
+
+	json.NewEncoder(w).Encode(v)
+}
+
+// fail writes an APIError response carrying the request ID of the request.
+func (this *FakeServer) fail(w http.ResponseWriter, r *http.Request, code int, ecode, msg string, fields ...FieldError) {
+
+	this.reply(w, code, &APIError{
+		Code: ecode,
+		Message: msg,
+		Fields: fields,
+		RequestID: r.Header.Get(`X-Request-ID`),
+	})
+}
+
+// save writes the store to the store file.
+func (this *FakeServer) save() {
+
+	if this.StoreFile == `` {
+		return
+	}
+
+	if _, err := makePath(filepath.Dir(this.StoreFile)); err != nil {
+		el.Printf(`fake server store %s not saved - %v`, this.StoreFile, err)
+	} else if b, err := json.MarshalIndent(&this.store, ``, "\t"); err != nil {
+		el.Printf(`fake server store %s not saved - %v`, this.StoreFile, err)
+	} else if err := ioutil.WriteFile(this.StoreFile, b, FileMode); err != nil {
+		el.Printf(`fake server store %s not saved - %v`, this.StoreFile, err)
+	}
+}
+
+// fakeDeviceID returns the vid-pid-sn identifier of a device in JSON form.
+func fakeDeviceID(j []byte) (string, error) {
+
+	var d struct {
+		VendorID string		`json:"vendor_id"`
+		ProductID string	`json:"product_id"`
+		SerialNum string	`json:"serial_number"`
+	}
+
+	if err := json.Unmarshal(j, &d); err != nil {
+		return ``, err
+	} else if d.VendorID == `` || d.ProductID == `` {
+		return ``, fmt.Errorf(`device has no vendor or product ID`)
+	}
+
+	return strings.Join([]string{d.VendorID, d.ProductID, d.SerialNum}, `-`), nil
+}
+
+// runFakeServer serves a fake server on the address, accepting the client
+// credentials from the configuration, until the context is cancelled.
+func runFakeServer(ctx context.Context, addr, storeFile string) (error) {
+
+	fs, err := newFakeServer(conf.Server.Endpoints,
+		conf.Server.Auth.Username, conf.Server.Auth.Password, storeFile,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	fs.IDs = usbIDs
+
+	if conf.Server.Signing.Enabled() {
+		fs.SigningKeys = map[string][]byte{conf.Client.HostName: conf.Server.Signing.key}
+		fs.MaxSkew = conf.Server.Signing.MaxSkew
+	}
+
+	srv := &http.Server{Addr: addr, Handler: fs}
+
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	sl.Printf(`fake server listening on %s`, addr)
+	fmt.Fprintf(os.Stderr, "fake cmdbd server listening on %s\n", addr)
+
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+
+	return nil
+}
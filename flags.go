@@ -20,12 +20,38 @@ var (
 	fsAction = flag.NewFlagSet("action", flag.ExitOnError)
 	fActionAudit = fsAction.Bool("audit", false, "Audit devices")
 	fActionCheckin = fsAction.Bool("checkin", false, "Check devices in")
+	fActionFakeServer = fsAction.Bool("fake-server", false, "Run a fake cmdbd server")
+	fActionFlush = fsAction.Bool("flush", false, "Deliver spooled submissions")
+	fActionImportIDs = fsAction.Bool("import-ids", false, "Import USB ID database")
 	fActionReport = fsAction.Bool("report", false, "Report actions")
 	fActionReset = fsAction.Bool("reset", false, "Reset device")
 	fActionSerial = fsAction.Bool("serial", false, "Set serial number")
+	fActionServerInfo = fsAction.Bool("server-info", false, "Show server version and features")
+	fActionSetCredentials = fsAction.Bool("set-credentials", false, "Save encrypted credentials")
 	fActionState = fsAction.Bool("state", false, "Show device state")
 	fActionVersion = fsAction.Bool("version", false, "Display version")
 
+	fsGlobal = flag.NewFlagSet("global", flag.ExitOnError)
+	fGlobalConfig = fsGlobal.String("config", "", "Load configuration overrides from `<file>`")
+	fGlobalTimeout = fsGlobal.Duration("timeout", 0, "Abort run after `<duration>`")
+	fGlobalRefreshMeta = fsGlobal.Bool("refresh-meta", false, "Discard cached vendor and product names")
+	fGlobalForceCheckin = fsGlobal.Bool("force-checkin", false, "Check devices in even if unchanged")
+	fGlobalTrace = fsGlobal.String("trace", "", "Record HTTP exchanges in HAR `<file>`")
+	fGlobalOutput = fsGlobal.String("output", "", "Print device results to stdout in `<format>` {json|ndjson}")
+
+	fsCheckin = flag.NewFlagSet("checkin", flag.ExitOnError)
+	fCheckinBatch = fsCheckin.Bool("batch", false, "Check all devices in with one request")
+
+	fsCredentials = flag.NewFlagSet("set-credentials", flag.ExitOnError)
+	fCredUsername = fsCredentials.String("username", "", "Authenticate as `<username>`")
+	fCredPassword = fsCredentials.String("password", "", "Authenticate with `<password>` (prompt if omitted)")
+
+	fsFakeServer = flag.NewFlagSet("fake-server", flag.ExitOnError)
+	fFakeServerStore = fsFakeServer.String("store", "", "Keep fake server data in `<file>`")
+
+	fsImportIDs = flag.NewFlagSet("import-ids", flag.ExitOnError)
+	fImportIDsFrom = fsImportIDs.String("from", "", "Import usb.ids from `<path|url>`")
+
 	fsReport = flag.NewFlagSet("report", flag.ExitOnError)
 	fReportFolder = fsReport.String("folder", "", "Write reports to `<path>`")
 	fReportFormat = fsReport.String("format", "json", "Report `<format>` {csv|nvp|xml|json}")
@@ -38,3 +64,18 @@ var (
 	fSerialFetch = fsSerial.Bool("fetch", false, "Fetch serial number from server")
 	fSerialSet = fsSerial.String("set", "", "Set serial number to `<string>`")
 )
+
+// init makes the global options available to each action's option set.
+func init() {
+
+	fsGlobal.VisitAll(func(f *flag.Flag) {
+		fsCheckin.Var(f.Value, f.Name, f.Usage)
+		fsFakeServer.Var(f.Value, f.Name, f.Usage)
+		fsImportIDs.Var(f.Value, f.Name, f.Usage)
+		fsReport.Var(f.Value, f.Name, f.Usage)
+		fsSerial.Var(f.Value, f.Name, f.Usage)
+	})
+
+	f := fsGlobal.Lookup(`config`)
+	fsCredentials.Var(f.Value, f.Name, f.Usage)
+}
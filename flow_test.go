@@ -1,6 +1,7 @@
 package main
 
 import (
+	`context`
 	`crypto/sha256`
 	`fmt`
 	`io/ioutil`
@@ -54,13 +55,13 @@ func TestFlowAudit(t *testing.T) {
 	// Check device in with the database to ensure there is at least one record
 	// to use for comparison.
 
-	err = checkin(td.Mag[`mag1`])
+	err = checkin(context.Background(), td.Mag[`mag1`])
 	gotest.Ok(t, err)
 
-	err = checkin(td.Idt[`idt1`])
+	err = checkin(context.Background(), td.Idt[`idt1`])
 	gotest.Ok(t, err)
 
-	err = checkin(td.Gen[`gen1`])
+	err = checkin(context.Background(), td.Gen[`gen1`])
 	gotest.Ok(t, err)
 
 	t.Run(`Flags: -audit (no changes)`, func(t *testing.T) {
@@ -70,12 +71,12 @@ func TestFlowAudit(t *testing.T) {
 
 		// Send device to router.
 
-		err = route(td.Mag[`mag1`])
+		err = route(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		// Determine whether there are no changes recorded when auditing same device.
 
-		err = route(td.Mag[`mag1`])
+		err = route(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		gotest.Assert(t, len(td.Mag[`mag1`].Changes) == 0, `device change log should be empty`)
@@ -88,17 +89,17 @@ func TestFlowAudit(t *testing.T) {
 
 		// Send device to router.
 
-		err = route(td.Mag[`mag1`])
+		err = route(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		// Determine whether there are no changes recorded when auditing same device.
 
-		err = route(td.Mag[`mag1`])
+		err = route(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		// Determine whether device differences are recorded in device change log.
 
-		err = route(td.Mag[`mag2`])
+		err = route(context.Background(), td.Mag[`mag2`])
 		gotest.Ok(t, err)
 
 		gotest.Assert(t, reflect.DeepEqual(td.Mag[`mag2`].Changes, td.Chg),
@@ -132,12 +133,12 @@ func TestFlowCheckin(t *testing.T) {
 
 		// Send device to router.
 
-		err = route(td.Mag[`mag2`])
+		err = route(context.Background(), td.Mag[`mag2`])
 		gotest.Ok(t, err)
 
 		// Checkout device and test if property change persisted.
 
-		b, err := checkout(td.Mag[`mag2`])
+		b, err := checkout(context.Background(), td.Mag[`mag2`])
 		gotest.Ok(t, err)
 
 		err = td.Mag[`mag2`].RestoreJSON(b)
@@ -161,7 +162,7 @@ func TestFlowReport(t *testing.T) {
 
 		// Send device to router.
 
-		err = route(td.Mag[`mag1`])
+		err = route(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		// Test whether signature of report file content is correct.
@@ -187,7 +188,7 @@ func TestFlowReport(t *testing.T) {
 
 		// Send device to router.
 
-		err = route(td.Mag[`mag1`])
+		err = route(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		// Test whether signature of report file content is correct.
@@ -213,7 +214,7 @@ func TestFlowReport(t *testing.T) {
 
 		// Send device to router.
 
-		err = route(td.Mag[`mag1`])
+		err = route(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		// Test whether signature of report file content is correct.
@@ -239,7 +240,7 @@ func TestFlowReport(t *testing.T) {
 
 		// Send device to router.
 
-		err = route(td.Mag[`mag1`])
+		err = route(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		// Test whether signature of report file content is correct.
@@ -302,7 +303,7 @@ func TestFlowSerial(t *testing.T) {
 		*fActionSerial = true
 		*fSerialDefault = true
 
-		err = route(mdev)
+		err = route(context.Background(), mdev)
 		gotest.Assert(t, err != nil, `attempt to set SN when one already exists should produce error`)
 	})
 
@@ -325,7 +326,7 @@ func TestFlowSerial(t *testing.T) {
 		*fActionSerial = true
 		*fSerialFetch = true
 
-		err = route(mdev)
+		err = route(context.Background(), mdev)
 		gotest.Assert(t, err != nil, `attempt to set SN when one already exists should produce error`)
 	})
 
@@ -348,7 +349,7 @@ func TestFlowSerial(t *testing.T) {
 		*fActionSerial = true
 		*fSerialSet = newSn
 
-		err = route(mdev)
+		err = route(context.Background(), mdev)
 		gotest.Assert(t, err != nil, `attempt to set SN when one already exists should produce error`)
 	})
 
@@ -372,7 +373,7 @@ func TestFlowSerial(t *testing.T) {
 		*fSerialErase = true
 		*fSerialDefault = true
 
-		err = route(mdev)
+		err = route(context.Background(), mdev)
 		gotest.Ok(t, err)
 		gotest.Assert(t, mdev.DeviceSN == mdev.FactorySN[:7], `attempt to set device SN to factory SN failed`)
 	})
@@ -393,7 +394,7 @@ func TestFlowSerial(t *testing.T) {
 		*fSerialErase = true
 		*fSerialFetch = true
 
-		err = route(mdev)
+		err = route(context.Background(), mdev)
 		gotest.Ok(t, err)
 		gotest.Assert(t, mdev.DeviceSN[:4] == `24HF`, `attempt to set device SN from server failed`)
 	})
@@ -414,7 +415,7 @@ func TestFlowSerial(t *testing.T) {
 		*fSerialErase = true
 		*fSerialSet = newSn
 
-		err = route(mdev)
+		err = route(context.Background(), mdev)
 		gotest.Ok(t, err)
 		gotest.Assert(t, mdev.DeviceSN == newSn, `attempt to set device SN to string failed`)
 	})
@@ -439,7 +440,7 @@ func TestFlowSerial(t *testing.T) {
 		*fSerialForce = true
 		*fSerialDefault = true
 
-		err = route(mdev)
+		err = route(context.Background(), mdev)
 		gotest.Ok(t, err)
 		gotest.Assert(t, mdev.DeviceSN == mdev.FactorySN[:7], `attempt to set device SN to factory SN failed`)
 	})
@@ -460,7 +461,7 @@ func TestFlowSerial(t *testing.T) {
 		*fSerialForce = true
 		*fSerialFetch = true
 
-		err = route(mdev)
+		err = route(context.Background(), mdev)
 		gotest.Ok(t, err)
 		gotest.Assert(t, mdev.DeviceSN[:4] == `24HF`, `attempt to set device SN from server failed`)
 	})
@@ -481,7 +482,7 @@ func TestFlowSerial(t *testing.T) {
 		*fSerialForce = true
 		*fSerialSet = newSn
 
-		err = route(mdev)
+		err = route(context.Background(), mdev)
 		gotest.Ok(t, err)
 		gotest.Assert(t, mdev.DeviceSN == newSn, `attempt to set device SN to string failed`)
 	})
@@ -508,7 +509,7 @@ func TestFlowSerial(t *testing.T) {
 		resetFlags(t)
 		*fActionReset = true
 
-		err = route(mdev)
+		err = route(context.Background(), mdev)
 		gotest.Ok(t, err)
 
 		time.Sleep(5 * time.Second)
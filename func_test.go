@@ -1,13 +1,29 @@
 package main
 
 import (
+	`bytes`
+	`context`
 	`crypto/sha256`
+	`encoding/base64`
+	`encoding/json`
+	`encoding/pem`
+	`encoding/xml`
+	`errors`
 	`fmt`
 	`io/ioutil`
+	`net`
+	`net/http`
+	`net/http/httptest`
+	`net/url`
+	`os`
 	`path/filepath`
 	`reflect`
 	`strings`
 	`testing`
+	`testing/iotest`
+	`time`
+	`github.com/google/gousb`
+	`github.com/jscherff/cmdb/ci/peripheral/usb`
 	`github.com/jscherff/gotest`
 )
 
@@ -16,35 +32,164 @@ import (
 
 	Config Helper Functions:
 
-	[ ] newConfig(cf string) (*Config, error)
-	[ ] loadConfig(t interface{}, cf string) error
+	[ ] newConfig(cfs ...string) (*Config, error)
+	[X] (*Config).validateAuth() (error)
+	[X] configFiles(name, file string) ([]string, error)
+	[X] loadConfig(t interface{}, cf string) error
 	[ ] makePath(path string) (string, error)
 
 	Router Functions:
 
-	[X] route(i interface{}) (err error)
+	[X] route(ctx context.Context, i interface{}) (err error)
 	[X] convert(i interface{}) (interface{}, error)
-	[ ] update(i interface{}) (interface{})
+	[ ] update(ctx context.Context, i interface{}, desc *gousb.DeviceDesc) (interface{}, *Classes)
 
 	Action Functions:
 
-	[ ] audit(dev usb.Auditer) (err error)
+	[ ] audit(ctx context.Context, dev usb.Auditer) (err error)
 	[X] report(dev usb.Reporter) (err error)
-	[X] serial(dev usb.Serializer) (err error)
+	[X] serial(ctx context.Context, dev usb.Serializer) (err error)
 
 	API Client Functions:
 
-	[X] newSn(dev usb.Serializer) (string, error)
-	[X] checkin(dev usb.Reporter) (error)
-	[X] checkout(dev usb.Auditer) ([]byte, error)
-	[ ] sendAudit(dev usb.Auditer) (error)
-	[ ] vendor(dev usb.Updater) (s string, err error)
-	[ ] product(dev usb.Updater) (s string, err error)
+	[X] newSn(ctx context.Context, dev usb.Serializer) (string, error)
+	[X] checkin(ctx context.Context, dev usb.Reporter) (error)
+	[X] checkout(ctx context.Context, dev usb.Auditer) ([]byte, error)
+	[ ] sendAudit(ctx context.Context, dev usb.Auditer) (error)
+	[ ] vendor(ctx context.Context, dev usb.Updater) (s string, err error)
+	[ ] product(ctx context.Context, dev usb.Updater) (s string, err error)
+
+	Spool Functions:
+
+	[X] (*Spool).Put(key string, params []string, body []byte) (error)
+	[X] (*Spool).Entries() ([]string, error)
+	[X] (*Spool).Flush(ctx context.Context) (n, rejected int, err error)
+	[X] (*Spool).deliver(ctx context.Context, fn string, e *SpoolEntry) (sent, accepted bool, err error)
+
+	File Backend Functions:
+
+	[X] newFileBackend(dir string) (*fileBackend, error)
+	[X] (*fileBackend).Checkin(ctx context.Context, dev usb.Reporter) (error)
+	[X] (*fileBackend).Checkout(ctx context.Context, dev usb.Auditer) ([]byte, error)
+	[X] (*fileBackend).devicePath(dev usb.Reporter) (string)
+	[X] safeName(s string) (string)
+
+	Batch Checkin Functions:
+
+	[X] checkinBatch(ctx context.Context, devs []usb.Reporter) ([]error)
+	[X] postBatch(ctx context.Context, devs []usb.Reporter) ([]error)
+	[X] checkinEach(ctx context.Context, devs []usb.Reporter) ([]error)
+
+	Operation ID Functions:
+
+	[X] checkinPending(ctx context.Context, pending []*DeviceResult, ops []string)
+	[X] resumeOp(id string)
+
+	Credential Functions:
+
+	[X] readCredentials(fn string) (*Credentials, error)
+	[X] sealCredentials(fn string, creds *Credentials) (error)
+	[X] openCredentials(fn string) (*Credentials, error)
+	[X] redactArgs(args []string) ([]string)
+
+	Proxy Functions:
+
+	[X] (*Proxy).Bypass(u *url.URL) (bool)
+
+	TLS Functions:
+
+	[X] (*TLS).Config() (*tls.Config, error)
+	[X] tlsError(req *http.Request, err error) (error)
+
+	Retry Policy Functions:
+
+	[X] (*Retry).Retryable(req *http.Request, resp *http.Response, err error) (bool)
+	[X] (*Retry).Delay(retry int, resp *http.Response) (time.Duration)
+
+	Metadata Cache Functions:
+
+	[X] (*MetaCache).Lookup(key string, fetch func() (string, error)) (string, error)
+	[X] (*MetaCache).Clear() (error)
+
+	USB ID Database Functions:
+
+	[X] parseUsbIDs(r io.Reader) (*UsbIDs, error)
+	[X] importUsbIDs(ctx context.Context, src, dst string) (error)
+
+	Checkin Cache Functions:
+
+	[X] contentHash(j []byte) (string)
+	[X] (*CheckinCache).Unchanged(dev usb.Reporter, j []byte) (bool)
+	[X] checkin(ctx context.Context, dev usb.Reporter) (error) with If-None-Match
+
+	HTTP Trace Functions:
+
+	[X] (*Tracer).RoundTrip(req *http.Request) (*http.Response, error)
+	[X] (*Tracer).Via(rt http.RoundTripper) (http.RoundTripper)
+
+	Cassette Functions:
+
+	[X] (*Cassette).RoundTrip(req *http.Request) (*http.Response, error)
+
+	Fake Server Functions:
+
+	[X] (*FakeServer).ServeHTTP(w http.ResponseWriter, r *http.Request)
+
+	OAuth2 Functions:
+
+	[X] (*OAuth2).Token(ctx context.Context) (string, error)
+	[X] tokenRequest(req *http.Request) (*httpResult, error)
+	[X] authorize(req *http.Request) (error)
+
+	API Negotiation Functions:
+
+	[X] negotiate(ctx context.Context) (*ServerInfo, error)
+	[X] serverInfo(ctx context.Context, sa *ServerAddr) (*ServerInfo, error)
+	[X] rebase(req *http.Request, from map[string]string)
+	[X] matchEndpoint(eps map[string]string, path string) (string, []interface{}, bool)
+	[X] (*ServerList).Info() (*ServerInfo)
+	[X] (*ServerList).Endpoints() (map[string]string)
+	[X] (*ServerInfo).Supports(feature string) (bool)
+
+	Request Signing Functions:
+
+	[X] (*Signing).Sign(req *http.Request, keyID string) (error)
+	[X] verifySignature(r *http.Request, keys func(id string) ([]byte, bool), maxSkew time.Duration) (error)
+
+	API Error Functions:
+
+	[X] newAPIError(hr *httpResult) (*APIError)
+	[X] apiErrorCode(err error) (string)
+
+	Exit Status Functions:
+
+	[X] (*runStatus).Code() (int)
+	[X] (*runStatus).End(code int, err error)
+	[X] authFailure(err error) (bool)
+	[X] errorCode(err error) (int)
+
+	Device Result Output Functions:
+
+	[X] (*runStatus).Begin(vid, pid string) (*DeviceResult)
+	[X] (*runStatus).Flush() (error)
+
+	USB Class Functions:
+
+	[X] classify(ctx context.Context, desc *gousb.DeviceDesc) (*Classes)
+	[X] (*classified).JSON() ([]byte, error)
+	[X] mergeCSV(b []byte, f [][2]string) ([]byte, error)
+	[X] mergeNVP(b []byte, f [][2]string) ([]byte)
+	[X] mergeXML(b, x []byte) ([]byte)
+
+	Server Failover Functions:
+
+	[X] (*ServerList).Select(ctx context.Context)
+	[X] httpRequest(req *http.Request) (*httpResult, error)
 
 	HTTP Helper Functions:
 
-	[ ] httpPost(url string, j []byte ) (b []byte, hs httpStatus, err error)
-	[ ] httpGet(url string) (b []byte, hs httpStatus, err error)
+	[ ] httpPost(ctx context.Context, url string, j []byte ) (b []byte, hs httpStatus, err error)
+	[ ] httpGet(ctx context.Context, url string) (b []byte, hs httpStatus, err error)
 	[ ] httpRequest(req *http.Request) (b []byte, hs httpStatus, err error)
 */
 
@@ -57,7 +202,7 @@ func TestFuncSerial(t *testing.T) {
 		resetFlags(t)
 		td.Mag[`mag1`].SerialNum = ``
 
-		td.Mag[`mag1`].SerialNum, err = newSn(td.Mag[`mag1`])
+		td.Mag[`mag1`].SerialNum, err = newSn(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 		gotest.Assert(t, td.Mag[`mag1`].SerialNum != ``, `empty SN provided by server`)
 		//TODO: assert correct serial number format
@@ -68,7 +213,7 @@ func TestFuncSerial(t *testing.T) {
 		resetFlags(t)
 		td.Idt[`idt1`].SerialNum = ``
 
-		td.Idt[`idt1`].SerialNum, err = newSn(td.Idt[`idt1`])
+		td.Idt[`idt1`].SerialNum, err = newSn(context.Background(), td.Idt[`idt1`])
 		gotest.Ok(t, err)
 		gotest.Assert(t, td.Idt[`idt1`].SerialNum != ``, `empty SN provided by server`)
 		//TODO: assert correct serial number format
@@ -80,7 +225,7 @@ func TestFuncSerial(t *testing.T) {
 		td.Idt[`idt1`].SerialNum = ``
 		td.Idt[`idt1`].ObjectType = `*usb.Unknown`
 
-		td.Idt[`idt1`].SerialNum, err = newSn(td.Idt[`idt1`])
+		td.Idt[`idt1`].SerialNum, err = newSn(context.Background(), td.Idt[`idt1`])
 		gotest.Ok(t, err)
 		gotest.Assert(t, td.Idt[`idt1`].SerialNum != ``, `empty SN provided by server`)
 		//TODO: assert correct serial number format
@@ -188,10 +333,10 @@ func TestFuncCheckInOut(t *testing.T) {
 
 		resetFlags(t)
 
-		err = checkin(td.Mag[`mag1`])
+		err = checkin(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
-		j, err := checkout(td.Mag[`mag1`])
+		j, err := checkout(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		ss, err := td.Mag[`mag1`].CompareJSON(j)
@@ -203,12 +348,12 @@ func TestFuncCheckInOut(t *testing.T) {
 
 		resetFlags(t)
 
-		err = checkin(td.Mag[`mag1`])
+		err = checkin(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		td.Mag[`mag1`].SoftwareID = `21042818B02`
 
-		j, err := checkout(td.Mag[`mag1`])
+		j, err := checkout(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		ss, err := td.Mag[`mag1`].CompareJSON(j)
@@ -228,15 +373,15 @@ func TestFuncAudit(t *testing.T) {
 		resetFlags(t)
 		*fActionAudit = true
 
-		err = checkin(td.Mag[`mag1`])
+		err = checkin(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
-		err = audit(td.Mag[`mag1`])
+		err = audit(context.Background(), td.Mag[`mag1`])
 		gotest.Ok(t, err)
 
 		gotest.Assert(t, len(td.Mag[`mag1`].Changes) == 0, `device change log should be empty`)
 
-		err = audit(td.Mag[`mag2`])
+		err = audit(context.Background(), td.Mag[`mag2`])
 		gotest.Ok(t, err)
 
 		gotest.Assert(t, reflect.DeepEqual(td.Mag[`mag2`].Changes, td.Chg),
@@ -253,3 +398,1889 @@ func TestFuncAudit(t *testing.T) {
 
 	restoreState(t)
 }
+
+func TestFuncRetry(t *testing.T) {
+
+	rp := &Retry{MaxAttempts: 5, BaseBackoff: 1, MaxBackoff: 4}
+	gotest.Ok(t, rp.Init())
+
+	get, _ := http.NewRequest(http.MethodGet, `http://localhost/`, nil)
+	post, _ := http.NewRequest(http.MethodPost, `http://localhost/`, nil)
+
+	dialErr := &net.OpError{Op: `dial`, Err: errors.New(`connection refused`)}
+	readErr := &net.OpError{Op: `read`, Err: errors.New(`connection reset`)}
+
+	status := func(code int, hdr ...string) (*http.Response) {
+		resp := &http.Response{StatusCode: code, Header: http.Header{}}
+		if len(hdr) > 0 {
+			resp.Header.Set(`Retry-After`, hdr[0])
+		}
+		return resp
+	}
+
+	t.Run("Retryable() Must Retry Idempotent Requests on Any Failure", func(t *testing.T) {
+
+		gotest.Assert(t, rp.Retryable(get, nil, readErr), `GET should be retried after read error`)
+		gotest.Assert(t, rp.Retryable(get, status(502), nil), `GET should be retried after 502`)
+		gotest.Assert(t, rp.Retryable(get, status(429), nil), `GET should be retried after 429`)
+		gotest.Assert(t, !rp.Retryable(get, status(404), nil), `GET should not be retried after 404`)
+	})
+
+	t.Run("Retryable() Must Not Retry POST Unless Unprocessed", func(t *testing.T) {
+
+		gotest.Assert(t, !rp.Retryable(post, nil, readErr), `POST should not be retried after read error`)
+		gotest.Assert(t, !rp.Retryable(post, status(500), nil), `POST should not be retried after 500`)
+		gotest.Assert(t, !rp.Retryable(post, status(503), nil), `POST should not be retried after bare 503`)
+		gotest.Assert(t, rp.Retryable(post, nil, dialErr), `POST should be retried after dial error`)
+		gotest.Assert(t, rp.Retryable(post, status(429), nil), `POST should be retried after 429`)
+		gotest.Assert(t, rp.Retryable(post, status(503, `5`), nil), `POST should be retried after 503 with Retry-After`)
+	})
+
+	t.Run("Delay() Must Back Off Exponentially up to Limit", func(t *testing.T) {
+
+		gotest.Assert(t, rp.Delay(1, nil) == 1 * time.Second, `first retry delay should be base backoff`)
+		gotest.Assert(t, rp.Delay(2, nil) == 2 * time.Second, `second retry delay should double`)
+		gotest.Assert(t, rp.Delay(5, nil) == 4 * time.Second, `delay should not exceed max backoff`)
+	})
+
+	t.Run("Delay() Must Honor Retry-After up to Limit", func(t *testing.T) {
+
+		gotest.Assert(t, rp.Delay(1, status(503, `3`)) == 3 * time.Second, `delay should match Retry-After`)
+		gotest.Assert(t, rp.Delay(1, status(503, `7`)) == 4 * time.Second, `Retry-After should not exceed max backoff`)
+		gotest.Assert(t, rp.Delay(1, status(503, time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))) == 4 * time.Second,
+			`Retry-After date should not exceed max backoff`,
+		)
+	})
+}
+
+func TestFuncSpool(t *testing.T) {
+
+	sp := &Spool{Dir: filepath.Join(conf.Paths.SpoolDir, `test`)}
+
+	_, err := makePath(sp.Dir)
+	gotest.Ok(t, err)
+
+	params := []string{conf.Client.HostName, `0801`, `0001`}
+
+	t.Run("Put() Must Queue Submissions in Order", func(t *testing.T) {
+
+		gotest.Ok(t, sp.Put(`usb_ci_checkin`, params, td.Jsn[`mag1`]))
+		gotest.Ok(t, sp.Put(`usb_ci_checkin`, params, td.Jsn[`mag2`]))
+
+		fns, err := sp.Entries()
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(fns) == 2, `spool should hold two entries`)
+
+		e := &SpoolEntry{}
+		gotest.Ok(t, loadConfig(e, fns[0]))
+		gotest.Assert(t, string(e.Body) == string(td.Jsn[`mag1`]), `first entry should be first submission`)
+	})
+
+	t.Run("Put() Must Not Queue Duplicate Submissions", func(t *testing.T) {
+
+		gotest.Ok(t, sp.Put(`usb_ci_checkin`, params, td.Jsn[`mag1`]))
+
+		fns, err := sp.Entries()
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(fns) == 2, `duplicate submission should not be queued`)
+	})
+
+	t.Run("Flush() Must Log Outcomes Under Operation IDs", func(t *testing.T) {
+
+		useFakeServer(t)
+		b := captureLog(t, sl)
+
+		n, r, err := sp.Flush(context.Background())
+		gotest.Ok(t, err)
+		gotest.Assert(t, n == 2 && r == 0, `both submissions should be delivered`)
+
+		for _, line := range strings.Split(b.String(), "\n") {
+			if strings.Contains(line, `accepted`) {
+				gotest.Assert(t, strings.Contains(line, ` op=`), `outcome should carry operation ID: ` + line)
+			}
+		}
+
+		gotest.Assert(t, strings.Count(b.String(), `accepted`) == 2, `both outcomes should be logged`)
+	})
+
+	t.Run("Flush() Must Not Count Rejected Submissions as Delivered", func(t *testing.T) {
+
+		gotest.Ok(t, sp.Put(`usb_ci_checkin`, params, td.Jsn[`mag1`]))
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+
+		defer ts.Close()
+
+		u, _ := url.Parse(ts.URL)
+
+		addrs, session := servers, authenticated
+		defer func() { servers, authenticated = addrs, session }()
+
+		servers = newServerList(&ServerAddr{u.Scheme, u.Hostname(), u.Port()}, nil)
+		servers.probed = true
+		authenticated = true
+
+		n, r, err := sp.Flush(context.Background())
+		gotest.Ok(t, err)
+		gotest.Assert(t, n == 0 && r == 1, `rejected submission should be counted apart`)
+
+		fns, err := sp.Entries()
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(fns) == 0, `rejected submission should be set aside`)
+
+		rejects, err := filepath.Glob(filepath.Join(sp.Dir, `*` + RejectExt))
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(rejects) == 1, `rejected submission should be kept`)
+
+		for _, fn := range rejects {
+			gotest.Ok(t, os.Remove(fn))
+		}
+	})
+
+	saved, password, retry := spool, conf.Server.Auth.Password, conf.Client.Retry
+	defer func() { spool, conf.Server.Auth.Password, conf.Client.Retry = saved, password, retry }()
+
+	spool = sp
+	conf.Client.Retry = &Retry{MaxAttempts: 1}
+
+	t.Run("checkin() Must Not Spool When Credentials Are Refused", func(t *testing.T) {
+
+		useFakeServer(t)
+		conf.Server.Auth.Password = `wrong`
+		defer func() { conf.Server.Auth.Password = password }()
+
+		err := checkin(context.Background(), td.Mag[`mag1`])
+		gotest.Assert(t, authFailure(err), `refused credentials should be reported`)
+
+		fns, err := sp.Entries()
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(fns) == 0, `checkin should not be spooled`)
+	})
+
+	t.Run("checkin() Must Spool When Server Fails During Authentication", func(t *testing.T) {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+
+		defer ts.Close()
+
+		u, _ := url.Parse(ts.URL)
+
+		addrs, session := servers, authenticated
+		defer func() { servers, authenticated = addrs, session }()
+
+		servers = newServerList(&ServerAddr{u.Scheme, u.Hostname(), u.Port()}, nil)
+		authenticated = false
+
+		err := checkin(context.Background(), td.Mag[`mag1`])
+		gotest.Assert(t, err != nil && !authFailure(err), `unavailable server should not be an authentication failure`)
+
+		fns, err := sp.Entries()
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(fns) == 1, `checkin should be spooled`)
+
+		for _, fn := range fns {
+			os.Remove(fn)
+		}
+	})
+}
+
+// connDevice is a device attached to a given USB connection.
+type connDevice struct {
+	usb.Auditer
+	conn string
+}
+
+func (this *connDevice) Conn() (string) {
+	return this.conn
+}
+
+// Test that the file backend keeps the latest checkin of each device.
+func TestFuncFileBackend(t *testing.T) {
+
+	fb, err := newFileBackend(t.TempDir())
+	gotest.Ok(t, err)
+
+	ctx := context.Background()
+
+	t.Run("Checkout() Must Return Device Saved by Checkin()", func(t *testing.T) {
+
+		for _, dev := range []usb.Auditer{td.Mag[`mag1`], td.Idt[`idt1`]} {
+
+			gotest.Ok(t, fb.Checkin(ctx, dev))
+
+			want, err := dev.JSON()
+			gotest.Ok(t, err)
+
+			j, err := fb.Checkout(ctx, dev)
+			gotest.Ok(t, err)
+			gotest.Assert(t, bytes.Equal(j, want), `checked out device should match checked in device`)
+		}
+	})
+
+	t.Run("Checkout() Must Fail for Device Never Checked In", func(t *testing.T) {
+
+		fb2, err := newFileBackend(t.TempDir())
+		gotest.Ok(t, err)
+
+		_, err = fb2.Checkout(ctx, td.Mag[`mag1`])
+		gotest.Assert(t, err != nil && strings.Contains(err.Error(), `no checkin`), `missing checkin should fail`)
+	})
+
+	t.Run("Unserialized Devices Must Not Overwrite Each Other", func(t *testing.T) {
+
+		d1 := &connDevice{td.Gen[`gen1`], `P01-B01`}
+		d2 := &connDevice{td.Gen[`gen1`], `P02-B01`}
+
+		gotest.Assert(t, d1.SN() == ``, `test device should have no serial number`)
+		gotest.Assert(t, fb.devicePath(d1) != fb.devicePath(d2), `devices on different connections should be kept apart`)
+
+		for _, dev := range []*connDevice{d1, d2} {
+
+			gotest.Ok(t, fb.Checkin(ctx, dev))
+
+			want, err := dev.JSON()
+			gotest.Ok(t, err)
+
+			j, err := ioutil.ReadFile(fb.devicePath(dev))
+			gotest.Ok(t, err)
+			gotest.Assert(t, bytes.Equal(j, want), `saved checkin should match device`)
+		}
+
+		fns, err := filepath.Glob(filepath.Join(fb.Dir, `devices`, d1.VID() + `-` + d1.PID() + `@*`))
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(fns) == 2, `each device should have its own checkin`)
+	})
+
+	t.Run("devicePath() Must Keep Unsafe Characters Out of File Names", func(t *testing.T) {
+
+		dev := &connDevice{td.Gen[`gen1`], `../../P01/B01:1`}
+		dir := filepath.Join(fb.Dir, `devices`)
+
+		fn := fb.devicePath(dev)
+		gotest.Assert(t, filepath.Dir(fn) == dir, `checkin should be kept in devices folder: ` + fn)
+		gotest.Assert(t, filepath.Base(fn) == dev.VID() + `-` + dev.PID() + `@.._.._P01_B01_1.json`, `unsafe characters should be replaced: ` + fn)
+	})
+}
+
+// Test batch checkin result mapping and fallback to individual checkins.
+func TestFuncCheckinBatch(t *testing.T) {
+
+	var (
+		unsupported, reject, single int
+		reverse bool
+	)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if !strings.Contains(r.URL.Path, `/batch/`) {
+			single++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+
+		if unsupported != 0 {
+			w.WriteHeader(unsupported)
+			return
+		}
+
+		var res []batchResult
+
+		if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		for i := range res {
+			if res[i].Status = http.StatusCreated; i == reject {
+				res[i].Status, res[i].Code, res[i].Message = http.StatusConflict, ErrCodeDuplicateSerial, `duplicate`
+			}
+		}
+
+		if reverse {
+			for i, j := 0, len(res) - 1; i < j; i, j = i + 1, j - 1 {
+				res[i], res[j] = res[j], res[i]
+			}
+		}
+
+		json.NewEncoder(w).Encode(res)
+	}))
+
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+
+	saved, session, cache := servers, authenticated, conf.CheckinCache
+	defer func() { servers, authenticated, conf.CheckinCache = saved, session, cache }()
+
+	servers = newServerList(&ServerAddr{u.Scheme, u.Hostname(), u.Port()}, nil)
+	servers.probed = true
+	authenticated = true
+
+	conf.CheckinCache = &CheckinCache{Mode: `off`}
+	gotest.Ok(t, conf.CheckinCache.Init())
+
+	devs := []usb.Reporter{td.Mag[`mag1`], td.Idt[`idt1`]}
+
+	t.Run("postBatch() Must Map Results to Devices", func(t *testing.T) {
+
+		unsupported, reject, reverse = 0, 1, false
+
+		errs := postBatch(context.Background(), devs)
+
+		gotest.Assert(t, len(errs) == 2 && errs[0] == nil, `first device should be accepted`)
+		gotest.Assert(t, apiErrorCode(errs[1]) == ErrCodeDuplicateSerial, `second device should be refused`)
+	})
+
+	t.Run("postBatch() Must Refuse Results for Other Devices", func(t *testing.T) {
+
+		unsupported, reject, reverse = 0, -1, true
+
+		for _, err := range postBatch(context.Background(), devs) {
+			gotest.Assert(t, err != nil && strings.Contains(err.Error(), `result is for`), `mismatched result should fail`)
+		}
+	})
+
+	t.Run("checkinBatch() Must Map Results Past Unchanged Devices", func(t *testing.T) {
+
+		resetFlags(t)
+		unsupported, reject, reverse = 0, 0, false
+
+		conf.CheckinCache = &CheckinCache{Mode: `local`}
+		gotest.Ok(t, conf.CheckinCache.Init())
+		defer func() { conf.CheckinCache = &CheckinCache{Mode: `off`} }()
+
+		j, err := td.Mag[`mag1`].JSON()
+		gotest.Ok(t, err)
+		conf.CheckinCache.Accept(td.Mag[`mag1`], j)
+
+		errs := checkinBatch(context.Background(), devs)
+
+		gotest.Assert(t, errs[0] == nil, `unchanged device should be skipped`)
+		gotest.Assert(t, apiErrorCode(errs[1]) == ErrCodeDuplicateSerial, `result should be mapped to changed device`)
+	})
+
+	for _, stat := range []int{http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented} {
+
+		t.Run(fmt.Sprintf("postBatch() Must Check In Individually After %d", stat), func(t *testing.T) {
+
+			unsupported, reject, reverse, single = stat, -1, false, 0
+
+			for _, err := range postBatch(context.Background(), devs) {
+				gotest.Ok(t, err)
+			}
+
+			gotest.Assert(t, single == len(devs), `devices should be checked in individually`)
+		})
+	}
+}
+
+// Test that batched devices can be traced to the operations that collected them.
+func TestFuncCheckinPending(t *testing.T) {
+
+	useFakeServer(t)
+
+	savedStatus, savedBatch := status, batch
+	defer func() { status, batch = savedStatus, savedBatch }()
+
+	status = runStatus{}
+	batch = []usb.Reporter{td.Mag[`mag1`], td.Mag[`mag2`]}
+
+	pending := []*DeviceResult{status.Begin(`0801`, `0001`), status.Begin(`0801`, `0001`)}
+	ops := []string{`collect1`, `collect2`}
+
+	sb, eb := captureLog(t, sl), captureLog(t, el)
+
+	t.Run("Batch Operation Must Map Devices to Their Operations", func(t *testing.T) {
+
+		checkinPending(context.Background(), pending, ops)
+
+		for i, dev := range batch {
+
+			want := fmt.Sprintf(`device %s-%s-%s batched from operation %s`, dev.VID(), dev.PID(), dev.SN(), ops[i])
+			gotest.Assert(t, strings.Contains(sb.String(), want), `mapping should be logged: ` + want)
+		}
+
+		gotest.Assert(t, !strings.Contains(sb.String(), `op=collect1 device`), `mapping should be logged under batch operation`)
+		gotest.Assert(t, eb.Len() == 0, eb.String())
+	})
+
+	t.Run("Device Outcomes Must Be Recorded and Operation Ended", func(t *testing.T) {
+
+		gotest.Assert(t, pending[0].Outcome == OutcomeSuccess && pending[1].Outcome == OutcomeSuccess, `outcomes should be recorded`)
+		gotest.Assert(t, !strings.Contains(sl.Logger.Prefix(), `op=`), `operation should be ended`)
+	})
+
+	t.Run("resumeOp() Must Restore Operation ID", func(t *testing.T) {
+
+		resumeOp(`collect2`)
+		defer endOp()
+
+		gotest.Assert(t, strings.Contains(sl.Logger.Prefix(), `op=collect2`), `operation ID should be restored`)
+	})
+}
+
+func TestFuncTLS(t *testing.T) {
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+
+	cert := srv.Certificate()
+	caFile := filepath.Join(conf.Paths.ReportDir, `ca.pem`)
+
+	err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: `CERTIFICATE`, Bytes: cert.Raw}), FileMode)
+	gotest.Ok(t, err)
+
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := `sha256/` + base64.StdEncoding.EncodeToString(sum[:])
+
+	get := func(ts *TLS) (error) {
+
+		tc, err := ts.Config()
+		gotest.Ok(t, err)
+
+		req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+
+		if resp, err := client.Do(req); err != nil {
+			return tlsError(req, err)
+		} else {
+			return resp.Body.Close()
+		}
+	}
+
+	t.Run("Config() Must Trust Configured CA", func(t *testing.T) {
+
+		err := get(&TLS{CAFile: caFile})
+		gotest.Ok(t, err)
+	})
+
+	t.Run("Config() Must Accept Matching Pin", func(t *testing.T) {
+
+		err := get(&TLS{CAFile: caFile, Pins: []string{pin}})
+		gotest.Ok(t, err)
+	})
+
+	t.Run("Config() Must Reject Unknown CA", func(t *testing.T) {
+
+		err := get(&TLS{})
+		gotest.Assert(t, err != nil && strings.Contains(err.Error(), `trusted CA`),
+			`connection to server with untrusted certificate should fail`)
+	})
+
+	t.Run("Config() Must Reject Mismatched Pin", func(t *testing.T) {
+
+		err := get(&TLS{CAFile: caFile, Pins: []string{`sha256/AAAA`}})
+		gotest.Assert(t, err != nil && strings.Contains(err.Error(), `pinned`),
+			`connection to server with unpinned key should fail`)
+	})
+}
+
+func TestFuncCredentials(t *testing.T) {
+
+	creds := &Credentials{Username: `testuser`, Password: `testpass`}
+
+	t.Run("openCredentials() Must Decrypt sealCredentials() Output", func(t *testing.T) {
+
+		fn := filepath.Join(conf.Paths.ReportDir, `credentials.enc`)
+		gotest.Ok(t, sealCredentials(fn, creds))
+
+		c, err := openCredentials(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, reflect.DeepEqual(c, creds), `decrypted credentials do not match`)
+	})
+
+	t.Run("readCredentials() Must Refuse Unprotected File", func(t *testing.T) {
+
+		fn := filepath.Join(conf.Paths.ReportDir, `credentials.json`)
+		gotest.Ok(t, ioutil.WriteFile(fn, []byte(`{"Username":"u","Password":"p"}`), CredFileMode))
+
+		c, err := readCredentials(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, c.Username == `u` && c.Password == `p`, `credentials not read from protected file`)
+
+		gotest.Ok(t, os.Chmod(fn, 0644))
+
+		_, err = readCredentials(fn)
+		gotest.Assert(t, err != nil, `credentials file readable by others should be refused`)
+	})
+
+	t.Run("openCredentials() Must Not Depend on Executable Name", func(t *testing.T) {
+
+		fn := filepath.Join(conf.Paths.ReportDir, `credentials.enc`)
+		gotest.Ok(t, sealCredentials(fn, creds))
+
+		saved := program
+		defer func() { program = saved }()
+
+		program = `renamed`
+
+		c, err := openCredentials(fn)
+		gotest.Ok(t, err)
+		gotest.Assert(t, reflect.DeepEqual(c, creds), `credentials should survive renaming the executable`)
+	})
+
+	t.Run("redactArgs() Must Hide Password", func(t *testing.T) {
+
+		args := []string{`-set-credentials`, `-username`, `u`, `-password`, `s3cret`, `--password=s3cret`}
+		out := strings.Join(redactArgs(args), ` `)
+
+		gotest.Assert(t, !strings.Contains(out, `s3cret`), `password should be redacted`)
+		gotest.Assert(t, strings.Contains(out, `-username u`) && args[4] == `s3cret`, `other arguments should be kept`)
+	})
+}
+
+func TestFuncProxy(t *testing.T) {
+
+	px := &Proxy{
+		URL: `http://proxy.example.com:3128`,
+		NoProxy: []string{`.corp.example.com`, `localhost`, `10.0.0.0/8`, `cmdb.example.com:8443`},
+	}
+
+	bypass := func(s string) (bool) {
+		u, err := url.Parse(s)
+		gotest.Ok(t, err)
+		return px.Bypass(u)
+	}
+
+	t.Run("Bypass() Must Match NoProxy Entries", func(t *testing.T) {
+
+		gotest.Assert(t, bypass(`http://corp.example.com/`), `domain should be bypassed`)
+		gotest.Assert(t, bypass(`http://cmdb.corp.example.com:8080/`), `subdomain should be bypassed`)
+		gotest.Assert(t, bypass(`http://localhost:8080/`), `host should be bypassed`)
+		gotest.Assert(t, bypass(`http://10.1.2.3:8080/`), `address in CIDR block should be bypassed`)
+		gotest.Assert(t, bypass(`https://cmdb.example.com:8443/`), `host and port should be bypassed`)
+	})
+
+	t.Run("Bypass() Must Not Match Other Destinations", func(t *testing.T) {
+
+		gotest.Assert(t, !bypass(`http://example.com/`), `parent domain should be proxied`)
+		gotest.Assert(t, !bypass(`http://notcorp.example.com/`), `similar domain should be proxied`)
+		gotest.Assert(t, !bypass(`http://192.168.1.1/`), `address outside CIDR block should be proxied`)
+		gotest.Assert(t, !bypass(`http://cmdb.example.com:8080/`), `host on other port should be proxied`)
+	})
+
+	t.Run("Func() Must Attach Proxy Credentials", func(t *testing.T) {
+
+		px.Username, px.Password = `puser`, `ppass`
+		defer func() { px.Username, px.Password = ``, `` }()
+
+		pf, err := px.Func()
+		gotest.Ok(t, err)
+
+		req, _ := http.NewRequest(http.MethodGet, `http://cmdb.example.com/`, nil)
+		pu, err := pf(req)
+		gotest.Ok(t, err)
+		gotest.Assert(t, pu != nil && pu.User.String() == `puser:ppass`, `proxy URL should carry credentials`)
+	})
+}
+
+func TestFuncFailover(t *testing.T) {
+
+	var hits [2]int
+
+	handler := func(n, code int) (http.Handler) {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[n]++
+			w.WriteHeader(code)
+			fmt.Fprint(w, `"Magtek"`)
+		})
+	}
+
+	down := httptest.NewServer(handler(0, http.StatusServiceUnavailable))
+	defer down.Close()
+
+	up := httptest.NewServer(handler(1, http.StatusOK))
+	defer up.Close()
+
+	addr := func(s *httptest.Server) (*ServerAddr) {
+		u, _ := url.Parse(s.URL)
+		return &ServerAddr{Protocol: u.Scheme, HostName: u.Hostname(), Port: u.Port()}
+	}
+
+	saved, retry := servers, conf.Client.Retry
+	defer func() { servers, conf.Client.Retry = saved, retry }()
+
+	conf.Client.Retry = &Retry{MaxAttempts: 1}
+
+	t.Run("Select() Must Choose First Healthy Server", func(t *testing.T) {
+
+		servers = newServerList(addr(down), []*ServerAddr{addr(up)})
+		servers.Select(context.Background())
+		gotest.Assert(t, servers.Current().Host() == addr(up).Host(), `healthy alternate should be selected`)
+	})
+
+	t.Run("probe() Must Carry Run ID", func(t *testing.T) {
+
+		var id string
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id = r.Header.Get(`X-Run-ID`)
+		}))
+
+		defer ts.Close()
+
+		gotest.Ok(t, servers.probe(context.Background(), addr(ts)))
+		gotest.Assert(t, id == runID, `health check should carry run ID`)
+	})
+
+	t.Run("httpRequest() Must Fail Over to Next Server", func(t *testing.T) {
+
+		servers = newServerList(addr(down), []*ServerAddr{addr(up)})
+		servers.probed = true
+		hits = [2]int{}
+
+		s, err := vendor(context.Background(), td.Mag[`mag1`])
+		gotest.Ok(t, err)
+		gotest.Assert(t, s == `Magtek`, `vendor name should come from alternate server`)
+		gotest.Assert(t, hits[0] == 1 && hits[1] == 1, `request should be sent once to each server`)
+
+		_, err = vendor(context.Background(), td.Mag[`mag1`])
+		gotest.Ok(t, err)
+		gotest.Assert(t, hits[0] == 1 && hits[1] == 2, `last working server should be remembered`)
+	})
+
+	t.Run("httpRequest() Must Not Fail Over Delivered POST", func(t *testing.T) {
+
+		servers = newServerList(addr(down), []*ServerAddr{addr(up)})
+		servers.probed = true
+		hits = [2]int{}
+
+		hr, err := httpPost(context.Background(), endpoint(`usb_ci_newsn`, `h`, `0801`, `0001`), []byte(`{}`))
+		gotest.Ok(t, err)
+		gotest.Assert(t, hr.Status() == http.StatusServiceUnavailable, `server error should be returned`)
+		gotest.Assert(t, hits[0] == 1 && hits[1] == 0, `POST should not be replayed on another server`)
+	})
+
+	t.Run("httpRequest() Must Fail Over POST That Was Never Sent", func(t *testing.T) {
+
+		closed := httptest.NewServer(handler(0, http.StatusOK))
+		closed.Close()
+
+		servers = newServerList(addr(closed), []*ServerAddr{addr(up)})
+		servers.probed = true
+		hits = [2]int{}
+
+		hr, err := httpPost(context.Background(), endpoint(`usb_ci_newsn`, `h`, `0801`, `0001`), []byte(`{}`))
+		gotest.Ok(t, err)
+		gotest.Assert(t, hr.Status() == http.StatusOK && hits[1] == 1, `POST should be sent to alternate server`)
+	})
+
+	t.Run("auth() Must Fail Over When Authentication Fails With Server Error", func(t *testing.T) {
+
+		// The primary is healthy but cannot authenticate.
+
+		authPath := strings.Split(conf.Server.Endpoints[`cmdb_auth`], `%s`)[0]
+
+		broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[0]++
+			if strings.HasPrefix(r.URL.Path, authPath) {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+		}))
+
+		defer broken.Close()
+
+		session := authenticated
+		defer func() { authenticated = session }()
+
+		servers = newServerList(addr(broken), []*ServerAddr{addr(up)})
+		authenticated = false
+		hits = [2]int{}
+
+		gotest.Ok(t, auth(context.Background()))
+		gotest.Assert(t, authenticated, `session should be established`)
+		gotest.Assert(t, hits[0] == 2, `primary should be probed and asked to authenticate once`)
+		gotest.Assert(t, servers.Current().Host() == addr(up).Host(), `alternate server should be in use`)
+	})
+}
+
+func TestFuncMetaCache(t *testing.T) {
+
+	mc := &MetaCache{File: filepath.Join(filepath.Dir(conf.MetaCache.File), `test.json`), TTL: 1, NegativeTTL: 1}
+	gotest.Ok(t, mc.Init())
+
+	calls := 0
+
+	found := func() (string, error) { calls++; return `Magtek`, nil }
+	unknown := func() (string, error) { calls++; return ``, fmt.Errorf(`lookup failed - %w`, errUnknownID) }
+	failed := func() (string, error) { calls++; return ``, errors.New(`connection refused`) }
+
+	t.Run("Lookup() Must Cache Names Across Runs", func(t *testing.T) {
+
+		s, err := mc.Lookup(`vendor/0801`, found)
+		gotest.Ok(t, err)
+		gotest.Assert(t, s == `Magtek` && calls == 1, `name should be fetched on miss`)
+
+		mc2 := &MetaCache{File: mc.File, TTL: 1, NegativeTTL: 1}
+		gotest.Ok(t, mc2.Init())
+
+		s, err = mc2.Lookup(`vendor/0801`, found)
+		gotest.Ok(t, err)
+		gotest.Assert(t, s == `Magtek` && calls == 1, `name should be served from cache file`)
+	})
+
+	t.Run("Lookup() Must Cache Unknown IDs but Not Failures", func(t *testing.T) {
+
+		calls = 0
+
+		_, err := mc.Lookup(`vendor/ffff`, unknown)
+		_, err = mc.Lookup(`vendor/ffff`, unknown)
+		gotest.Assert(t, errors.Is(err, errUnknownID) && calls == 1, `unknown ID should be cached`)
+
+		_, err = mc.Lookup(`vendor/eeee`, failed)
+		_, err = mc.Lookup(`vendor/eeee`, failed)
+		gotest.Assert(t, err != nil && calls == 3, `failed lookup should not be cached`)
+	})
+
+	t.Run("Clear() Must Discard Cached Names", func(t *testing.T) {
+
+		calls = 0
+
+		gotest.Ok(t, mc.Clear())
+		_, err := mc.Lookup(`vendor/0801`, found)
+		gotest.Ok(t, err)
+		gotest.Assert(t, calls == 1, `name should be fetched after cache is cleared`)
+	})
+}
+
+// Test USB ID database parsing and import.
+func TestFuncUsbIDs(t *testing.T) {
+
+	db := "# List of USB ID's\n" +
+		"0801  MagTek\n" +
+		"\t0001  Mini Swipe Reader (Keyboard Emulation)\n" +
+		"\t0002  Mini Swipe Reader\n" +
+		"\t\t00  Interface\n" +
+		"0acd  ID TECH\n" +
+		"\t2030  ValueMag Magnetic Stripe Reader\n" +
+		"\n" +
+		"C 03  Human Interface Device\n" +
+		"\t01  Boot Interface Subclass\n" +
+		"\t\t01  Keyboard\n" +
+		"\t\t02  Mouse\n" +
+		"HID 01  Physical\n" +
+		"\t01  Ignored\n"
+
+	t.Run("parseUsbIDs() Must Resolve Vendors, Products, and Classes", func(t *testing.T) {
+
+		ids, err := parseUsbIDs(strings.NewReader(db))
+		gotest.Ok(t, err)
+
+		s, ok := ids.Vendor(`0ACD`)
+		gotest.Assert(t, ok && s == `ID TECH`, `vendor should be resolved`)
+
+		s, ok = ids.Product(`0801`, `0002`)
+		gotest.Assert(t, ok && s == `Mini Swipe Reader`, `product should be resolved`)
+
+		s, ok = ids.Protocol(`03`, `01`, `02`)
+		gotest.Assert(t, ok && s == `Mouse`, `protocol should be resolved`)
+
+		_, ok = ids.Product(`0801`, `0003`)
+		gotest.Assert(t, !ok, `unknown product should not be resolved`)
+
+		gotest.Assert(t, len(ids.Classes) == 1, `other sections should be skipped`)
+	})
+
+	t.Run("resolve() Must Use Database Only After Server Lookup Fails", func(t *testing.T) {
+
+		ids, err := parseUsbIDs(strings.NewReader(db))
+		gotest.Ok(t, err)
+
+		savedIDs, savedMode, offline := usbIDs, conf.UsbIDs.Mode, metaOffline
+		defer func() { usbIDs, conf.UsbIDs.Mode, metaOffline = savedIDs, savedMode, offline }()
+
+		usbIDs, conf.UsbIDs.Mode, metaOffline = ids, `fallback`, false
+
+		calls := 0
+
+		local := func() (string, bool) { return ids.Vendor(`0801`) }
+		unknown := func() (string, error) { calls++; return ``, errUnknownID }
+		failed := func() (string, error) { calls++; return ``, errors.New(`connection refused`) }
+
+		_, err = resolve(local, unknown)
+		gotest.Ok(t, err)
+		gotest.Assert(t, !metaOffline, `unknown ID should not stop server lookups`)
+
+		s, err := resolve(local, failed)
+		gotest.Ok(t, err)
+		gotest.Assert(t, s == `MagTek` && metaOffline, `database should be used when server fails`)
+
+		s, err = resolve(local, failed)
+		gotest.Ok(t, err)
+		gotest.Assert(t, s == `MagTek` && calls == 2, `server should not be asked again`)
+	})
+
+	t.Run("importUsbIDs() Must Verify and Install Database", func(t *testing.T) {
+
+		dir, err := ioutil.TempDir(``, `usbids`)
+		gotest.Ok(t, err)
+		defer os.RemoveAll(dir)
+
+		src := filepath.Join(dir, `new.ids`)
+		dst := filepath.Join(dir, `usb.ids`)
+
+		gotest.Ok(t, ioutil.WriteFile(src, []byte(db), FileMode))
+		gotest.Ok(t, importUsbIDs(context.Background(), src, dst))
+
+		ids, err := loadUsbIDs(dst)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(ids.Vendors) == 2, `imported database should be loaded`)
+
+		gotest.Ok(t, ioutil.WriteFile(src, []byte("# empty\n"), FileMode))
+		gotest.Assert(t, importUsbIDs(context.Background(), src, dst) != nil, `empty database should be rejected`)
+	})
+
+	t.Run("importUsbIDs() Must Download Without Server Client", func(t *testing.T) {
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, db)
+		}))
+
+		defer ts.Close()
+
+		// The server client refuses every request, as it would with TLS
+		// pins that do not match the download site.
+
+		saved := httpClient
+		defer func() { httpClient = saved }()
+
+		httpClient = &http.Client{Transport: roundTripFunc(func(*http.Request) (*http.Response, error) {
+			return nil, errors.New(`server client used`)
+		})}
+
+		dst := filepath.Join(t.TempDir(), `usb.ids`)
+
+		gotest.Ok(t, importUsbIDs(context.Background(), ts.URL + `/usb.ids`, dst))
+	})
+}
+
+// Test resolution of class names and their inclusion in device JSON.
+func TestFuncClasses(t *testing.T) {
+
+	db := "C 03  Human Interface Device\n" +
+		"\t01  Boot Interface Subclass\n" +
+		"\t\t01  Keyboard\n" +
+		"C 09  Hub\n" +
+		"\t00  Unused\n" +
+		"\t\t00  Full speed (or root) hub\n"
+
+	ids, err := parseUsbIDs(strings.NewReader(db))
+	gotest.Ok(t, err)
+
+	savedIDs, savedMode := usbIDs, conf.UsbIDs.Mode
+	usbIDs, conf.UsbIDs.Mode = ids, `primary`
+
+	defer func() {
+		usbIDs, conf.UsbIDs.Mode = savedIDs, savedMode
+	}()
+
+	t.Run("classify() Must Resolve Device Classes", func(t *testing.T) {
+
+		cn := classify(context.Background(), &gousb.DeviceDesc{Class: 0x09})
+
+		gotest.Assert(t, cn.ClassName == `Hub`, `device class should be resolved`)
+		gotest.Assert(t, cn.ProtocolName == `Full speed (or root) hub`, `device protocol should be resolved`)
+		gotest.Assert(t, len(cn.Interfaces) == 0, `interfaces should not be classified`)
+	})
+
+	t.Run("classify() Must Resolve Per-Interface Classes", func(t *testing.T) {
+
+		desc := &gousb.DeviceDesc{
+			Class: gousb.ClassPerInterface,
+			Configs: map[int]gousb.ConfigDesc{
+				1: {Number: 1, Interfaces: []gousb.InterfaceDesc{
+					{Number: 0, AltSettings: []gousb.InterfaceSetting{
+						{Class: 0x03, SubClass: 0x01, Protocol: 0x01},
+					}},
+				}},
+			},
+		}
+
+		cn := classify(context.Background(), desc)
+
+		gotest.Assert(t, len(cn.Interfaces) == 1, `interface should be classified`)
+		gotest.Assert(t, cn.Interfaces[0].Class == `03`, `interface class code should be recorded`)
+		gotest.Assert(t, cn.Interfaces[0].ProtocolName == `Keyboard`, `interface protocol should be resolved`)
+	})
+
+	t.Run("(*classified).JSON() Must Include Class Names", func(t *testing.T) {
+
+		dev := &classified{td.Mag[`mag1`], &Classes{ClassName: `Hub`}}
+
+		b, err := dev.JSON()
+		gotest.Ok(t, err)
+
+		m := make(map[string]interface{})
+		gotest.Ok(t, json.Unmarshal(b, &m))
+
+		gotest.Assert(t, m[`usb_class_name`] == `Hub`, `class name should be included`)
+		gotest.Assert(t, m[`vendor_id`] == td.Mag[`mag1`].VID(), `device fields should be preserved`)
+	})
+
+	cn := &Classes{
+		ClassName: `Hub`,
+		Interfaces: []*InterfaceClasses{{Number: 0, Class: `03`, ClassName: `Human Interface Device`}},
+	}
+
+	t.Run("mergeCSV() Must Append Class Names as Columns or Rows", func(t *testing.T) {
+
+		b, err := mergeCSV([]byte("vendor_id,product_id,serial_number\n0801,0001,B3C0EAB\n"), cn.fields())
+		gotest.Ok(t, err)
+
+		want := "vendor_id,product_id,serial_number,usb_class_name,usb_interface_0_usb_class,usb_interface_0_usb_class_name\n" +
+			"0801,0001,B3C0EAB,Hub,03,Human Interface Device\n"
+
+		gotest.Assert(t, string(b) == want, `class names should be appended as columns`)
+
+		b, err = mergeCSV([]byte("vendor_id,0801\nproduct_id,0001\n"), cn.fields())
+		gotest.Ok(t, err)
+
+		gotest.Assert(t, strings.HasSuffix(string(b), "usb_interface_0_usb_class_name,Human Interface Device\n"),
+			`class names should be appended as rows`)
+	})
+
+	t.Run("mergeNVP() Must Append Class Names With the Same Separator", func(t *testing.T) {
+
+		b := mergeNVP([]byte("vendor_id: 0801\nproduct_id: 0001\n"), cn.fields())
+
+		want := "vendor_id: 0801\nproduct_id: 0001\nusb_class_name: Hub\n" +
+			"usb_interface_0_usb_class: 03\nusb_interface_0_usb_class_name: Human Interface Device\n"
+
+		gotest.Assert(t, string(b) == want, `class names should be appended as pairs`)
+	})
+
+	t.Run("(*classified).PrettyXML() Merge Must Insert Class Names in the Root Element", func(t *testing.T) {
+
+		doc := []byte("<Magtek>\n  <vendor_id>0801</vendor_id>\n</Magtek>")
+
+		x, err := xml.MarshalIndent(cn, ``, xmlIndent(doc))
+		gotest.Ok(t, err)
+
+		b := mergeXML(doc, x)
+
+		v := struct {
+			VendorID string			`xml:"vendor_id"`
+			ClassName string		`xml:"usb_class_name"`
+			Interfaces []InterfaceClasses	`xml:"usb_interfaces>usb_interface"`
+		}{}
+
+		gotest.Ok(t, xml.Unmarshal(b, &v))
+
+		gotest.Assert(t, v.VendorID == `0801`, `device fields should be preserved`)
+		gotest.Assert(t, v.ClassName == `Hub`, `class name should be included`)
+		gotest.Assert(t, len(v.Interfaces) == 1 && v.Interfaces[0].Class == `03`, `interfaces should be included`)
+		gotest.Assert(t, bytes.Contains(b, []byte("\n  <usb_class_name>Hub</usb_class_name>\n")), `indentation should be preserved`)
+	})
+}
+
+// Test skipping of unchanged checkins.
+func TestFuncCheckinCache(t *testing.T) {
+
+	var hits, sent, stored int
+	var held string
+
+	// The server answers 304 only if the tag matches what it holds.
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		body, _ := ioutil.ReadAll(r.Body)
+		if tag := r.Header.Get(`If-None-Match`); tag != `` {
+			sent++
+			if tag == held {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		stored++
+		held = `"` + contentHash(body) + `"`
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	defer ts.Close()
+
+	u, _ := url.Parse(ts.URL)
+
+	saved, session, cache := servers, authenticated, conf.CheckinCache
+	defer func() { servers, authenticated, conf.CheckinCache = saved, session, cache }()
+
+	servers = newServerList(&ServerAddr{u.Scheme, u.Hostname(), u.Port()}, nil)
+	servers.probed = true
+	authenticated = true
+
+	t.Run("contentHash() Must Ignore Member Order and Whitespace", func(t *testing.T) {
+
+		gotest.Assert(t, contentHash([]byte(`{"a":1,"b":2}`)) == contentHash([]byte("{ \"b\": 2,\n\"a\": 1 }")),
+			`equivalent JSON should have the same hash`)
+	})
+
+	t.Run("checkin() Must Send If-None-Match With Hash of Current Device", func(t *testing.T) {
+
+		resetFlags(t)
+		conf.CheckinCache = &CheckinCache{Mode: `conditional`}
+		gotest.Ok(t, conf.CheckinCache.Init())
+		hits, sent, stored, held = 0, 0, 0, ``
+
+		gotest.Ok(t, checkin(context.Background(), td.Mag[`mag1`]))
+		gotest.Ok(t, checkin(context.Background(), td.Mag[`mag1`]))
+		gotest.Assert(t, hits == 2 && sent == 2 && stored == 1, `unchanged checkin should not be stored again`)
+
+		*fGlobalForceCheckin = true
+		gotest.Ok(t, checkin(context.Background(), td.Mag[`mag1`]))
+		gotest.Assert(t, hits == 3 && sent == 2 && stored == 2, `forced checkin should not be conditional`)
+	})
+
+	t.Run("checkin() Must Store Changed Device", func(t *testing.T) {
+
+		resetFlags(t)
+		conf.CheckinCache = &CheckinCache{Mode: `conditional`}
+		gotest.Ok(t, conf.CheckinCache.Init())
+		hits, sent, stored, held = 0, 0, 0, ``
+
+		dev := td.Mag[`mag1`]
+		gotest.Ok(t, checkin(context.Background(), dev))
+
+		saved := dev.SoftwareID
+		defer func() { dev.SoftwareID = saved }()
+
+		dev.SoftwareID = saved + `-changed`
+		gotest.Ok(t, checkin(context.Background(), dev))
+		gotest.Assert(t, stored == 2, `changed device should be stored`)
+
+		j, err := dev.JSON()
+		gotest.Ok(t, err)
+		gotest.Assert(t, held == conf.CheckinCache.Tag(j), `server should hold changed device`)
+		gotest.Assert(t, conf.CheckinCache.Unchanged(dev, j), `cache should record changed device`)
+	})
+
+	t.Run("checkin() Must Skip Unchanged Devices in Local Mode", func(t *testing.T) {
+
+		resetFlags(t)
+		conf.CheckinCache = &CheckinCache{Mode: `local`}
+		gotest.Ok(t, conf.CheckinCache.Init())
+		hits = 0
+
+		gotest.Ok(t, checkin(context.Background(), td.Mag[`mag1`]))
+		gotest.Ok(t, checkin(context.Background(), td.Mag[`mag1`]))
+		gotest.Assert(t, hits == 1, `unchanged device should not be checked in again`)
+
+		j, err := td.Mag[`mag2`].JSON()
+		gotest.Ok(t, err)
+		gotest.Assert(t, !conf.CheckinCache.Unchanged(td.Mag[`mag2`], j), `changed device should not be skipped`)
+	})
+}
+
+// Test recording of HTTP exchanges in HAR format.
+func TestFuncTrace(t *testing.T) {
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: `Auth-Token`, Value: `eyJhbGciOiJIUzI1NiJ9`})
+		w.Header().Set(`Content-Type`, `application/json`)
+		fmt.Fprint(w, `{"serial_number":"24F0000"}`)
+	}))
+
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir(``, `trace`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	tr := newTracer(http.DefaultTransport, filepath.Join(dir, `trace.har`))
+	hc := &http.Client{Transport: tr}
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(`{"Username":"cmdbc","Password":"s3cret"}`))
+	gotest.Ok(t, err)
+
+	req.Header.Set(`Content-Type`, `application/json`)
+	req.SetBasicAuth(`cmdbc`, `s3cret`)
+
+	resp, err := hc.Do(req)
+	gotest.Ok(t, err)
+
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	t.Run("RoundTrip() Must Preserve Response Body", func(t *testing.T) {
+		gotest.Ok(t, err)
+		gotest.Assert(t, string(b) == `{"serial_number":"24F0000"}`, `response body should be unchanged`)
+	})
+
+	t.Run("RoundTrip() Must Write HAR Entry Without Secrets", func(t *testing.T) {
+
+		b, err := ioutil.ReadFile(tr.File)
+		gotest.Ok(t, err)
+
+		var har harFile
+		gotest.Ok(t, json.Unmarshal(b, &har))
+
+		gotest.Assert(t, har.Log.Version == `1.2` && len(har.Log.Entries) == 1, `trace should hold one HAR 1.2 entry`)
+		gotest.Assert(t, har.Log.Entries[0].Response.Status == http.StatusOK, `response status should be recorded`)
+		gotest.Assert(t, strings.Contains(string(b), `24F0000`), `response body should be recorded`)
+
+		for _, secret := range []string{`s3cret`, `eyJhbGciOiJIUzI1NiJ9`, base64.StdEncoding.EncodeToString([]byte(`cmdbc:s3cret`))} {
+			gotest.Assert(t, !strings.Contains(string(b), secret), `secret should be redacted from trace`)
+		}
+	})
+
+	t.Run("RoundTrip() Must Return Only Error When Body Cannot Be Read", func(t *testing.T) {
+
+		tr := newTracer(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Header: http.Header{},
+				Body: ioutil.NopCloser(iotest.ErrReader(errors.New(`connection reset`))),
+				Request: req,
+			}, nil
+		}), filepath.Join(dir, `failed.har`))
+
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		gotest.Ok(t, err)
+
+		resp, err := tr.RoundTrip(req)
+		gotest.Assert(t, resp == nil && err != nil, `response should not be returned with error`)
+
+		b, err := ioutil.ReadFile(tr.File)
+		gotest.Ok(t, err)
+		gotest.Assert(t, strings.Contains(string(b), `connection reset`), `error should be recorded`)
+	})
+}
+
+// Test recording and replay of HTTP exchanges.
+func TestFuncCassette(t *testing.T) {
+
+	hits := 0
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits++
+		b, _ := ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"n":%d,"body":%q}`, hits, b)
+	}))
+
+	dir, err := ioutil.TempDir(``, `cassette`)
+	gotest.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, `test.json`)
+
+	post := func(rt http.RoundTripper, body string) (int, string, error) {
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL + `/v2/test`, strings.NewReader(body))
+
+		if err != nil {
+			return 0, ``, err
+		}
+
+		resp, err := (&http.Client{Transport: rt}).Do(req)
+
+		if err != nil {
+			return 0, ``, err
+		}
+
+		defer resp.Body.Close()
+		b, err := ioutil.ReadAll(resp.Body)
+
+		return resp.StatusCode, string(b), err
+	}
+
+	t.Run("Record Mode Must Save Interactions", func(t *testing.T) {
+
+		cs, err := newCassette(fn, CassetteRecord, http.DefaultTransport)
+		gotest.Ok(t, err)
+
+		_, _, err = post(cs, `{"a":1,"b":2}`)
+		gotest.Ok(t, err)
+		_, _, err = post(cs, `{"a":1,"b":2}`)
+		gotest.Ok(t, err)
+		_, _, err = post(cs, `{"a":2}`)
+		gotest.Ok(t, err)
+
+		gotest.Assert(t, hits == 3 && len(cs.Interactions) == 3, `all interactions should be recorded`)
+	})
+
+	ts.Close()
+
+	t.Run("Replay Mode Must Match Method, URL, and Body", func(t *testing.T) {
+
+		cs, err := newCassette(fn, CassetteReplay, http.DefaultTransport)
+		gotest.Ok(t, err)
+
+		code, body, err := post(cs, `{"b":2, "a":1}`)
+		gotest.Ok(t, err)
+		gotest.Assert(t, code == http.StatusCreated && strings.HasPrefix(body, `{"n":1,`), `first match should be replayed first`)
+
+		_, body, err = post(cs, `{"a":1,"b":2}`)
+		gotest.Ok(t, err)
+		gotest.Assert(t, strings.HasPrefix(body, `{"n":2,`), `repeated request should get next recorded response`)
+
+		_, body, err = post(cs, `{"a":2}`)
+		gotest.Ok(t, err)
+		gotest.Assert(t, strings.HasPrefix(body, `{"n":3,`), `request should be matched on body`)
+
+		_, _, err = post(cs, `{"a":3}`)
+		gotest.Assert(t, err != nil, `unrecorded request should fail`)
+	})
+}
+
+// Test the client against the fake server.
+func TestFuncFakeServer(t *testing.T) {
+
+	resetFlags(t)
+
+	fs := useFakeServer(t)
+	fs.IDs, _ = parseUsbIDs(strings.NewReader("0801  MagTek\n"))
+
+	dev := *td.Mag[`mag1`]
+	ctx := context.Background()
+
+	t.Run("Protected Endpoints Must Require Authentication", func(t *testing.T) {
+
+		hr, err := httpGet(ctx, endpoint(`usb_ci_checkout`, conf.Client.HostName, dev.VID(), dev.PID(), dev.SN()))
+		gotest.Ok(t, err)
+		gotest.Assert(t, hr.Status() == http.StatusUnauthorized, `request without token should be refused`)
+	})
+
+	t.Run("Metadata Lookups Must Not Require Authentication", func(t *testing.T) {
+
+		s, err := vendor(ctx, &dev)
+		gotest.Ok(t, err)
+		gotest.Assert(t, s == `MagTek`, `vendor should be resolved before authentication`)
+	})
+
+	t.Run("Client Must Authenticate and Obtain Serial Number", func(t *testing.T) {
+
+		gotest.Ok(t, auth(ctx))
+
+		sn, err := newSn(ctx, &dev)
+		gotest.Ok(t, err)
+		gotest.Assert(t, sn == `FAKE000001`, `fake serial number should be issued`)
+	})
+
+	t.Run("Checkout Must Return Checked-In Device", func(t *testing.T) {
+
+		gotest.Ok(t, checkin(ctx, &dev))
+
+		j, err := checkout(ctx, &dev)
+		gotest.Ok(t, err)
+
+		d, err := dev.JSON()
+		gotest.Ok(t, err)
+		gotest.Assert(t, contentHash(j) == contentHash(d), `checked-out device should match checkin`)
+	})
+
+	t.Run("Conditional Checkin Must Store Only Changed Devices", func(t *testing.T) {
+
+		saved := conf.CheckinCache
+		defer func() { conf.CheckinCache = saved }()
+
+		conf.CheckinCache = &CheckinCache{Mode: `conditional`}
+		gotest.Ok(t, conf.CheckinCache.Init())
+
+		id := strings.Join([]string{dev.VID(), dev.PID(), dev.SN()}, `-`)
+		old := fs.store.Devices[id]
+
+		gotest.Ok(t, checkin(ctx, &dev))
+		gotest.Assert(t, &fs.store.Devices[id][0] == &old[0], `unchanged device should not be stored again`)
+
+		sid := dev.SoftwareID
+		defer func() { dev.SoftwareID = sid }()
+
+		dev.SoftwareID = sid + `-changed`
+		gotest.Ok(t, checkin(ctx, &dev))
+
+		d, err := dev.JSON()
+		gotest.Ok(t, err)
+		gotest.Assert(t, contentHash(fs.store.Devices[id]) == contentHash(d), `changed device should be stored`)
+	})
+
+	t.Run("Audit and Metadata Endpoints Must Respond", func(t *testing.T) {
+
+		dev.SetChanges(td.Chg)
+		defer dev.SetChanges(nil)
+
+		gotest.Ok(t, sendAudit(ctx, &dev))
+		gotest.Assert(t, len(fs.store.Audits) == 1, `audit should be stored`)
+
+		s, err := vendor(ctx, &dev)
+		gotest.Ok(t, err)
+		gotest.Assert(t, s == `MagTek`, `vendor should be resolved from USB ID database`)
+
+		_, err = product(ctx, &dev)
+		gotest.Assert(t, errors.Is(err, errUnknownID), `unknown product should not be found`)
+	})
+}
+
+// Test OAuth2 client credentials authentication.
+func TestFuncOAuth2(t *testing.T) {
+
+	var issued, refused int
+
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		id, secret, _ := r.BasicAuth()
+		r.ParseForm()
+
+		// Server request headers must not reach the identity provider.
+
+		if r.Header.Get(`X-Run-ID`) != `` {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_request"}`)
+			return
+		}
+
+		if id != `cmdbc` || secret != `s3cret` || r.Form.Get(`grant_type`) != `client_credentials` {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+
+		issued++
+		w.Header().Set(`Content-Type`, `application/json`)
+		fmt.Fprintf(w, `{"access_token":"token%d","token_type":"Bearer","expires_in":3600}`, issued)
+	}))
+
+	defer idp.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// The first token is treated as revoked.
+
+		switch r.Header.Get(`Authorization`) {
+
+		case `Bearer token1`:
+			refused++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+
+		case fmt.Sprintf(`Bearer token%d`, issued):
+
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		fmt.Fprint(w, `"Magtek"`)
+	}))
+
+	defer api.Close()
+
+	u, _ := url.Parse(api.URL)
+
+	saved, session, mode, oa := servers, authenticated, conf.Server.Auth.Mode, conf.Server.Auth.OAuth2
+	defer func() { servers, authenticated, conf.Server.Auth.Mode, conf.Server.Auth.OAuth2 = saved, session, mode, oa }()
+
+	servers = newServerList(&ServerAddr{u.Scheme, u.Hostname(), u.Port()}, nil)
+	servers.probed = true
+	authenticated = false
+
+	conf.Server.Auth.Mode = AuthOAuth2
+
+	t.Run("auth() Must Fail With Invalid Client Secret", func(t *testing.T) {
+
+		conf.Server.Auth.OAuth2 = &OAuth2{TokenURL: idp.URL, ClientID: `cmdbc`, ClientSecret: `wrong`}
+
+		err := auth(context.Background())
+		gotest.Assert(t, authFailure(err) && strings.Contains(err.Error(), `invalid_client`), `invalid client should be refused`)
+	})
+
+	t.Run("Requests Must Carry Bearer Token and Refresh It When Refused", func(t *testing.T) {
+
+		conf.Server.Auth.OAuth2 = &OAuth2{TokenURL: idp.URL, ClientID: `cmdbc`, ClientSecret: `s3cret`}
+
+		gotest.Ok(t, auth(context.Background()))
+		gotest.Assert(t, issued == 1, `token should be obtained`)
+
+		s, err := vendor(context.Background(), td.Mag[`mag1`])
+		gotest.Ok(t, err)
+		gotest.Assert(t, s == `Magtek` && issued == 2 && refused == 1, `refused token should be replaced`)
+
+		_, err = vendor(context.Background(), td.Mag[`mag1`])
+		gotest.Ok(t, err)
+		gotest.Assert(t, issued == 2, `cached token should be reused`)
+	})
+
+	t.Run("Token Request Must Be Recorded in Trace Without Secrets", func(t *testing.T) {
+
+		saved := tracer
+		defer func() { tracer = saved }()
+
+		tracer = newTracer(http.DefaultTransport, filepath.Join(t.TempDir(), `trace.har`))
+
+		oa := &OAuth2{TokenURL: idp.URL, ClientID: `cmdbc`, ClientSecret: `s3cret`}
+
+		_, err := oa.Token(context.Background())
+		gotest.Ok(t, err)
+
+		b, err := ioutil.ReadFile(tracer.File)
+		gotest.Ok(t, err)
+		gotest.Assert(t, strings.Contains(string(b), idp.URL), `token request should be recorded`)
+
+		for _, secret := range []string{`s3cret`, fmt.Sprintf(`token%d`, issued), base64.StdEncoding.EncodeToString([]byte(`cmdbc:s3cret`))} {
+			gotest.Assert(t, !strings.Contains(string(b), secret), `secret should be redacted from trace`)
+		}
+	})
+
+	t.Run("validateAuth() Must Require Client Secret", func(t *testing.T) {
+
+		c := &Config{}
+		c.Server.Auth.Username = `cmdbc`
+		c.Server.Auth.Password = `basicpass`
+		c.Server.Auth.Mode = AuthOAuth2
+		c.Server.Auth.OAuth2 = &OAuth2{TokenURL: idp.URL}
+
+		t.Setenv(EnvClientSecret, ``)
+
+		err := c.validateAuth()
+		gotest.Assert(t, err != nil && strings.Contains(err.Error(), `client secret`), `missing client secret should fail`)
+		gotest.Assert(t, c.Server.Auth.OAuth2.ClientSecret == ``, `basic auth password should not be used as client secret`)
+
+		t.Setenv(EnvClientSecret, `s3cret`)
+
+		gotest.Ok(t, c.validateAuth())
+		gotest.Assert(t, c.Server.Auth.OAuth2.ClientSecret == `s3cret`, `client secret should be read from environment`)
+		gotest.Assert(t, c.Server.Auth.OAuth2.ClientID == `cmdbc`, `client ID should default to username`)
+	})
+}
+
+// Test API version negotiation.
+func TestFuncNegotiate(t *testing.T) {
+
+	var paths []string
+
+	// The v3 server reports its capabilities but cannot process requests.
+
+	v3 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, `/info`) {
+			fmt.Fprint(w, `{"version":"3.0.1","api_versions":["v2","v3","v4"],"features":["conditional_checkin"]}`)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+
+	defer v3.Close()
+
+	v2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, `/info`) {
+			fmt.Fprint(w, `{"version":"2.4.0","api_versions":["v2"],"features":[]}`)
+		} else {
+			paths = append(paths, r.URL.Path)
+			fmt.Fprint(w, `"Magtek"`)
+		}
+	}))
+
+	defer v2.Close()
+
+	addr := func(s *httptest.Server) (*ServerAddr) {
+		u, _ := url.Parse(s.URL)
+		return &ServerAddr{Protocol: u.Scheme, HostName: u.Hostname(), Port: u.Port()}
+	}
+
+	saved, sets, retry := servers, conf.Server.EndpointSets, conf.Client.Retry
+	defer func() { servers, conf.Server.EndpointSets, conf.Client.Retry = saved, sets, retry }()
+
+	servers = newServerList(addr(v3), []*ServerAddr{addr(v2)})
+	servers.probed = true
+
+	conf.Client.Retry = &Retry{MaxAttempts: 1}
+
+	conf.Server.EndpointSets = map[string]map[string]string{
+		`v3`: {`usb_meta_vendor`: `/v3/cmdb/meta/usb/vendor/%s`},
+	}
+
+	t.Run("negotiate() Must Select Newest Common API Version", func(t *testing.T) {
+
+		si, err := negotiate(context.Background())
+		gotest.Ok(t, err)
+
+		gotest.Assert(t, si.Version == `3.0.1` && si.API == `v3`, `v3 should be selected`)
+		gotest.Assert(t, servers.Endpoints()[`usb_meta_vendor`] == `/v3/cmdb/meta/usb/vendor/%s`, `v3 endpoint should be used`)
+		gotest.Assert(t, servers.Endpoints()[`usb_ci_checkin`] == conf.Server.Endpoints[`usb_ci_checkin`], `missing v3 endpoint should fall back to v2`)
+		gotest.Assert(t, conf.Server.Endpoints[`usb_meta_vendor`] != `/v3/cmdb/meta/usb/vendor/%s`, `default endpoints should not change`)
+	})
+
+	t.Run("httpRequest() Must Renegotiate With Server It Fails Over To", func(t *testing.T) {
+
+		s, err := vendor(context.Background(), td.Mag[`mag1`])
+		gotest.Ok(t, err)
+		gotest.Assert(t, s == `Magtek`, `vendor name should come from v2 server`)
+
+		gotest.Assert(t, servers.Info() != nil && servers.Info().API == DefaultAPI, `v2 should be selected for alternate server`)
+		gotest.Assert(t, len(paths) == 1 && paths[0] == fmt.Sprintf(conf.Server.Endpoints[`usb_meta_vendor`], td.Mag[`mag1`].VID()),
+			fmt.Sprintf(`request should use v2 endpoint, got %v`, paths),
+		)
+	})
+
+	t.Run("matchEndpoint() Must Recover Key and Parameters", func(t *testing.T) {
+
+		key, params, ok := matchEndpoint(conf.Server.Endpoints, `/v2/cmdb/ci/usb/checkin/host/0801/0001`)
+
+		gotest.Assert(t, ok && key == `usb_ci_checkin`, `checkin endpoint should match`)
+		gotest.Assert(t, reflect.DeepEqual(params, []interface{}{`host`, `0801`, `0001`}), `parameters should be recovered`)
+	})
+
+	t.Run("Supports() Must Honor Reported Features", func(t *testing.T) {
+
+		si := &ServerInfo{Features: []string{FeatureConditionalCheckin}}
+
+		gotest.Assert(t, si.Supports(FeatureConditionalCheckin), `reported feature should be supported`)
+		gotest.Assert(t, !si.Supports(FeatureBatchCheckin), `unreported feature should not be supported`)
+		gotest.Assert(t, (*ServerInfo)(nil).Supports(FeatureBatchCheckin), `unknown server should be assumed to support features`)
+	})
+}
+
+// Test HMAC request signing against the fake server.
+func TestFuncSigning(t *testing.T) {
+
+	resetFlags(t)
+
+	key := []byte(strings.Repeat(`k`, minKeyLen))
+
+	fs := useFakeServer(t)
+	fs.SigningKeys = map[string][]byte{conf.Client.HostName: key}
+	fs.MaxSkew = time.Minute
+
+	saved := conf.Server.Signing
+	defer func() { conf.Server.Signing = saved }()
+
+	ctx := context.Background()
+
+	t.Run("Unsigned Requests Must Be Refused", func(t *testing.T) {
+
+		conf.Server.Signing = &Signing{}
+
+		gotest.Ok(t, auth(ctx))
+		_, err := newSn(ctx, td.Mag[`mag1`])
+		gotest.Assert(t, err != nil, `unsigned request should be refused`)
+	})
+
+	t.Run("Signed Requests Must Be Accepted", func(t *testing.T) {
+
+		conf.Server.Signing = &Signing{key: key}
+
+		_, err := newSn(ctx, td.Mag[`mag1`])
+		gotest.Ok(t, err)
+	})
+
+	t.Run("verifySignature() Must Detect Altered Body", func(t *testing.T) {
+
+		sg := &Signing{key: key}
+
+		req, err := http.NewRequest(http.MethodPost, `http://cmdbd/v2/cmdb/ci/usb/checkin/h/0801/0001`, strings.NewReader(`{"a":1}`))
+		gotest.Ok(t, err)
+		gotest.Ok(t, sg.Sign(req, `h`))
+
+		keys := func(id string) ([]byte, bool) { return key, id == `h` }
+
+		req.Body = ioutil.NopCloser(strings.NewReader(`{"a":2}`))
+		gotest.Assert(t, verifySignature(req, keys, time.Minute) != nil, `altered body should fail verification`)
+
+		req.Body = ioutil.NopCloser(strings.NewReader(`{"a":1}`))
+		gotest.Ok(t, verifySignature(req, keys, time.Minute))
+	})
+
+	t.Run("Retries Must Be Signed With Current Timestamp", func(t *testing.T) {
+
+		var stamps []string
+
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			stamps = append(stamps, r.Header.Get(TimestampHeader))
+			keys := func(id string) ([]byte, bool) { return key, true }
+			if len(stamps) == 1 {
+				w.Header().Set(`Retry-After`, `1`)
+				w.WriteHeader(http.StatusTooManyRequests)
+			} else if err := verifySignature(r, keys, time.Second); err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+			}
+		}))
+
+		defer ts.Close()
+
+		retry := conf.Client.Retry
+		defer func() { conf.Client.Retry = retry }()
+
+		conf.Client.Retry = &Retry{MaxAttempts: 2, MaxBackoff: 2 * time.Second}
+		conf.Server.Signing = &Signing{key: key}
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL, strings.NewReader(`{}`))
+		gotest.Ok(t, err)
+
+		hr, err := httpSend(req)
+		gotest.Ok(t, err)
+		gotest.Assert(t, len(stamps) == 2 && stamps[0] != stamps[1], `retry should carry a new timestamp`)
+		gotest.Assert(t, hr.Status() == http.StatusOK, `retry should be signed`)
+	})
+}
+
+// Test typed API errors from rejected responses.
+func TestFuncAPIError(t *testing.T) {
+
+	resetFlags(t)
+
+	useFakeServer(t)
+
+	dev := *td.Mag[`mag1`]
+	ctx := context.Background()
+
+	t.Run("Unstructured Response Must Keep Raw Text", func(t *testing.T) {
+
+		ae := newAPIError(&httpResult{http.StatusBadRequest, httpContent(`"bad device"`), nil})
+		gotest.Assert(t, ae.Code == `` && ae.Message == `bad device`, `raw body should become message`)
+		gotest.Assert(t, ae.Error() == `Bad Request: bad device`, `error text should match raw response`)
+	})
+
+	t.Run("Duplicate Serial Number Must Be Identified", func(t *testing.T) {
+
+		gotest.Ok(t, auth(ctx))
+		gotest.Ok(t, checkin(ctx, &dev))
+
+		_, err := newSn(ctx, &dev)
+		gotest.Assert(t, apiErrorCode(err) == ErrCodeDuplicateSerial, `duplicate serial number should be reported`)
+
+		var ae *APIError
+
+		gotest.Assert(t, errors.As(err, &ae), `error should be an APIError`)
+		gotest.Assert(t, ae.Status == http.StatusConflict, `status should be conflict`)
+		gotest.Assert(t, len(ae.Fields) == 1 && ae.Fields[0].Field == `serial_number`, `field error should be reported`)
+		gotest.Assert(t, ae.RequestID != ``, `request ID should be reported`)
+	})
+
+	t.Run("Other Client Functions Must Return APIError", func(t *testing.T) {
+
+		// The copy shares the embedded device with the test data, so the
+		// serial number is restored afterward.
+
+		unknown, sn := dev, dev.SerialNum
+		defer func() { unknown.SerialNum = sn }()
+
+		unknown.SerialNum = `UNKNOWN`
+
+		_, err := checkout(ctx, &unknown)
+		gotest.Assert(t, apiErrorCode(err) == ErrCodeNotFound, `missing device should be not found`)
+	})
+}
+
+// Test aggregation of device outcomes into exit codes.
+func TestFuncExitStatus(t *testing.T) {
+
+	resetFlags(t)
+
+	fail := errors.New(`failed`)
+	auth := &authError{fail}
+
+	t.Run("Exit Codes Must Reflect Device Outcomes", func(t *testing.T) {
+
+		for _, tc := range []struct {
+			errs []error
+			changed int
+			code int
+		}{
+			{nil, 0, ExitNoDevices},
+			{[]error{nil, nil}, 0, ExitSuccess},
+			{[]error{nil, nil}, 1, ExitChanges},
+			{[]error{nil, fail}, 1, ExitPartial},
+			{[]error{nil, auth}, 0, ExitPartial},
+			{[]error{fail, fail}, 0, ExitFailure},
+			{[]error{fail, auth}, 0, ExitAuth},
+		} {
+			var rs runStatus
+
+			for _, err := range tc.errs {
+				rs.Record(&DeviceResult{}, err)
+			}
+
+			rs.Changed = tc.changed
+			gotest.Assert(t, rs.Code() == tc.code, fmt.Sprintf(`%v should exit %d, not %d`, tc.errs, tc.code, rs.Code()))
+		}
+	})
+
+	t.Run("Refused Credentials Must Be an Authentication Failure", func(t *testing.T) {
+
+		fs := useFakeServer(t)
+		fs.Password = `wrong`
+
+		_, err := newSn(context.Background(), td.Mag[`mag1`])
+		gotest.Assert(t, authFailure(err), `refused credentials should be an authentication failure`)
+		gotest.Assert(t, !authFailure(fail), `other errors should not be authentication failures`)
+	})
+
+	t.Run("Runs Without Devices Must Exit With Code for Error", func(t *testing.T) {
+
+		for _, tc := range []struct {
+			err error
+			code int
+		}{
+			{nil, ExitSuccess},
+			{fail, ExitFailure},
+			{fmt.Errorf(`flush failed - %w`, auth), ExitAuth},
+		} {
+			var rs runStatus
+
+			rs.End(errorCode(tc.err), tc.err)
+			gotest.Assert(t, rs.Code() == tc.code, fmt.Sprintf(`%v should exit %d, not %d`, tc.err, tc.code, rs.Code()))
+		}
+	})
+}
+
+// Test structured device results.
+func TestFuncOutput(t *testing.T) {
+
+	resetFlags(t)
+
+	saved := status
+	defer func() { status = saved }()
+
+	t.Run("Routed Device Result Must Be Complete", func(t *testing.T) {
+
+		useFakeServer(t)
+
+		*fActionCheckin = true
+		defer func() { *fActionCheckin = false }()
+
+		status = runStatus{}
+		dev := td.Mag[`mag1`]
+
+		res := status.Begin(dev.VID(), dev.PID())
+		status.Record(res, route(context.Background(), dev))
+
+		gotest.Assert(t, res.Outcome == OutcomeSuccess, res.Error)
+		gotest.Assert(t, res.Action == `checkin` && res.Driver == `magtek`, `action and driver should be reported`)
+		gotest.Assert(t, res.SerialNum == dev.SN(), `serial number should be reported`)
+		gotest.Assert(t, res.ServerStatus == http.StatusCreated, `server status should be reported`)
+	})
+
+	t.Run("ndjson Output Must Have One Line per Device and Summary", func(t *testing.T) {
+
+		var b bytes.Buffer
+
+		status = runStatus{Output: OutputNDJSON, Writer: &b}
+
+		status.Record(status.Begin(`0801`, `0001`), nil)
+		status.Record(status.Begin(`0801`, `0002`), &APIError{Status: http.StatusConflict, Message: `conflict`})
+		gotest.Ok(t, status.Flush())
+
+		lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+		gotest.Assert(t, len(lines) == 3, `two results and a summary should be written`)
+
+		var dr struct{ Device DeviceResult `json:"device"` }
+		var sr struct{ Summary runSummary `json:"summary"` }
+
+		gotest.Ok(t, json.Unmarshal([]byte(lines[1]), &dr))
+		gotest.Assert(t, dr.Device.Outcome == OutcomeFailure && dr.Device.ServerStatus == http.StatusConflict, `failure should be reported`)
+
+		gotest.Ok(t, json.Unmarshal([]byte(lines[2]), &sr))
+		gotest.Assert(t, sr.Summary.Succeeded == 1 && sr.Summary.Failed == 1 && sr.Summary.ExitCode == ExitPartial, `summary should be reported`)
+	})
+
+	t.Run("json Output Must Be One Document", func(t *testing.T) {
+
+		var b bytes.Buffer
+
+		status = runStatus{Output: OutputJSON, Writer: &b}
+
+		res := status.Begin(`0801`, `0001`)
+		status.Changes([][]string{{`SoftwareID`, `21042818B01`, `21042818B02`}})
+		status.Record(res, nil)
+		gotest.Ok(t, status.Flush())
+
+		var doc struct {
+			Devices []DeviceResult		`json:"devices"`
+			Summary runSummary		`json:"summary"`
+		}
+
+		gotest.Ok(t, json.Unmarshal(b.Bytes(), &doc))
+		gotest.Assert(t, len(doc.Devices) == 1 && len(doc.Devices[0].Changes) == 1, `changes should be reported`)
+		gotest.Assert(t, doc.Summary.ExitCode == ExitChanges, `exit code should be reported`)
+	})
+
+	t.Run("json Output Must Be Written for Runs Without Devices", func(t *testing.T) {
+
+		var b bytes.Buffer
+
+		status = runStatus{Output: OutputJSON, Writer: &b}
+
+		status.End(ExitAuth, &authError{errors.New(`invalid credentials`)})
+		gotest.Ok(t, status.Flush())
+
+		var doc struct {
+			Devices []DeviceResult		`json:"devices"`
+			Summary runSummary		`json:"summary"`
+		}
+
+		gotest.Ok(t, json.Unmarshal(b.Bytes(), &doc))
+		gotest.Assert(t, doc.Summary.ExitCode == ExitAuth, `exit code should be reported`)
+		gotest.Assert(t, strings.Contains(doc.Summary.Error, `invalid credentials`), `error should be reported`)
+	})
+
+	t.Run("Console Reports Must Not Be Written With Device Results", func(t *testing.T) {
+
+		var b, c bytes.Buffer
+
+		status = runStatus{Output: OutputJSON, Writer: &b}
+
+		console := Console
+		defer func() { Console = console }()
+
+		Console = &c
+
+		*fReportConsole, *fReportFormat = true, `json`
+		defer func() { *fReportConsole, *fReportFormat = false, `` }()
+
+		gotest.Ok(t, report(td.Mag[`mag1`]))
+		gotest.Assert(t, b.Len() == 0 && c.Len() > 0, `report should be written to console`)
+	})
+}
+
+// Test the configuration search order and layering.
+func TestFuncConfigFiles(t *testing.T) {
+
+	dn := t.TempDir()
+
+	xdg := filepath.Join(dn, ConfigDir, configFile)
+	env := filepath.Join(dn, `env.json`)
+	host := filepath.Join(dn, `host.json`)
+
+	gotest.Ok(t, os.MkdirAll(filepath.Dir(xdg), DirMode))
+
+	for _, fn := range []string{xdg, env} {
+		gotest.Ok(t, ioutil.WriteFile(fn, []byte(`{}`), FileMode))
+	}
+
+	gotest.Ok(t, ioutil.WriteFile(host, []byte(`{"Server": {"Port": "9090"}, "DebugLevel": 2}`), FileMode))
+
+	t.Setenv(`XDG_CONFIG_HOME`, dn)
+	t.Setenv(ConfigEnv, env)
+
+	t.Run("Files Must Be Found in Order of Precedence", func(t *testing.T) {
+
+		cfs, err := configFiles(configFile, host)
+		gotest.Ok(t, err)
+
+		n := len(cfs)
+		gotest.Assert(t, n >= 3 && cfs[n-3] == xdg && cfs[n-2] == env && cfs[n-1] == host,
+			fmt.Sprintf(`unexpected configuration files %v`, cfs),
+		)
+	})
+
+	t.Run("Missing Flag File Must Fail", func(t *testing.T) {
+
+		_, err := configFiles(configFile, filepath.Join(dn, `missing.json`))
+		gotest.Assert(t, err != nil, `missing configuration file should fail`)
+	})
+
+	t.Run("Later Files Must Override Earlier Files", func(t *testing.T) {
+
+		base, c := &Config{}, &Config{}
+
+		gotest.Ok(t, loadConfig(base, testConfFile))
+		gotest.Ok(t, loadConfig(c, testConfFile))
+		gotest.Ok(t, loadConfig(c, host))
+
+		gotest.Assert(t, c.Server.Port == `9090` && c.DebugLevel == 2, `host file should override settings`)
+		gotest.Assert(t, c.Server.HostName == base.Server.HostName && c.Server.Auth.Username == base.Server.Auth.Username,
+			`other settings should be kept`,
+		)
+	})
+}
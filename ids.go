@@ -0,0 +1,72 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`context`
+	`crypto/rand`
+	`encoding/hex`
+)
+
+// ctxKey is the type of keys for values the client stores in a context.
+type ctxKey int
+
+const (
+	opIDKey ctxKey = iota
+)
+
+// runID identifies every log entry and API call made during this run.
+var runID = newID()
+
+// newID generates a random correlation ID.
+func newID() (string) {
+
+	b := make([]byte, 8)
+
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// withOpID returns a context carrying the operation ID for one device.
+func withOpID(ctx context.Context, id string) (context.Context) {
+	return context.WithValue(ctx, opIDKey, id)
+}
+
+// opID returns the operation ID carried by the context, if any.
+func opID(ctx context.Context) (string) {
+	id, _ := ctx.Value(opIDKey).(string)
+	return id
+}
+
+// startOp begins a new operation: it generates an operation ID, adds it to
+// the context, and includes it in subsequent log entries.
+func startOp(ctx context.Context) (context.Context) {
+	id := newID()
+	conf.Loggers.SetIDs(runID, id)
+	return withOpID(ctx, id)
+}
+
+// resumeOp includes the ID of an earlier operation in subsequent log entries.
+func resumeOp(id string) {
+	conf.Loggers.SetIDs(runID, id)
+}
+
+// endOp removes the operation ID from subsequent log entries.
+func endOp() {
+	conf.Loggers.SetIDs(runID, ``)
+}
@@ -15,10 +15,14 @@
 package main
 
 import (
+	`bytes`
 	`flag`
 	`fmt`
 	`log`
+	`net/http/httptest`
+	`net/url`
 	`os`
+	`path/filepath`
 	`sync`
 	`testing`
 	`github.com/google/gousb`
@@ -40,6 +44,8 @@ var (
 	mux sync.Mutex
 	testConfFile = `config.json`
 	testDataFile = `tdata.json`
+	testCassetteFile = filepath.Join(`testdata`, `cassettes`, `cmdbc.json`)
+	testHostName = `cmdbc-test`
 )
 
 func init() {
@@ -60,23 +66,113 @@ func init() {
 func TestMain(m *testing.M) {
 
 	flag.Parse()
+
+	if mode := os.Getenv(`CMDBC_CASSETTE`); mode != `` {
+		useCassette(mode)
+	}
+
 	rc := m.Run()
 	os.RemoveAll(conf.Loggers.LogDir)
 	os.RemoveAll(conf.Paths.ReportDir)
+	os.RemoveAll(conf.Paths.SpoolDir)
+	os.RemoveAll(filepath.Dir(conf.MetaCache.File))
 	os.Exit(rc)
 }
 
+// useCassette records exchanges with the configured servers in, or replays
+// them from, the test cassette so that tests can run without a server once
+// a recording has been made. The client host name is pinned so that
+// recordings replay on any host. Set CMDBC_CASSETTE to 'record' while a
+// server is available and to 'replay' to run without it. Tests that need
+// attached devices still need them when replaying.
+func useCassette(mode string) {
+
+	conf.Client.HostName = testHostName
+
+	cs, err := newCassette(testCassetteFile, mode, httpClient.Transport)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cs.Hosts = make(map[string]bool)
+
+	for _, sa := range servers.addrs {
+		cs.Hosts[sa.Host()] = true
+	}
+
+	httpClient.Transport = cs
+}
+
+// useFakeServer points the client at a new fake server, with a fresh
+// session, until the end of the test.
+func useFakeServer(tb testing.TB) (*FakeServer) {
+
+	tb.Helper()
+
+	fs, err := newFakeServer(conf.Server.Endpoints,
+		conf.Server.Auth.Username, conf.Server.Auth.Password, ``,
+	)
+
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	jar, err := newCookieJar()
+
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	ts := httptest.NewServer(fs)
+	u, _ := url.Parse(ts.URL)
+
+	saved, session, savedJar, offline := servers, authenticated, httpClient.Jar, metaOffline
+
+	servers = newServerList(&ServerAddr{u.Scheme, u.Hostname(), u.Port()}, nil)
+	authenticated, httpClient.Jar, metaOffline = false, jar, false
+
+	tb.Cleanup(func() {
+		ts.Close()
+		servers, authenticated, httpClient.Jar, metaOffline = saved, session, savedJar, offline
+	})
+
+	return fs
+}
+
+// captureLog redirects the entries of a logger to a buffer for the
+// duration of a test.
+func captureLog(tb testing.TB, l *Logger) (*bytes.Buffer) {
+
+	var b bytes.Buffer
+
+	w := l.Writer()
+	l.SetOutput(&b)
+
+	tb.Cleanup(func() { l.SetOutput(w) })
+
+	return &b
+}
+
 func resetFlags(tb testing.TB) {
 
 	tb.Helper()
 
 	*fActionAudit = false
 	*fActionCheckin = false
+	*fActionFakeServer = false
+	*fActionFlush = false
+	*fActionImportIDs = false
 	*fActionReport = false
 	*fActionReset = false
+	*fActionServerInfo = false
 	*fActionSerial = false
 	*fActionVersion = false
 
+	*fCheckinBatch = false
+	*fGlobalForceCheckin = false
+	*fGlobalOutput = ``
+
 	*fReportConsole = false
 	*fReportFolder = conf.Paths.ReportDir
 	*fReportFormat = ``
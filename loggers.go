@@ -15,6 +15,7 @@
 package main
 
 import (
+	`fmt`
 	`log`
 	`io`
 	`io/ioutil`
@@ -34,6 +35,9 @@ var (
 		`time`:		log.Ltime,
 		`file`:		log.Lshortfile,
 	}
+
+	// LogConsole receives log entries for loggers with Console enabled.
+	LogConsole io.Writer = os.Stdout
 )
 
 // Loggers contains a collection of log.Logger objects with embedded
@@ -70,6 +74,14 @@ func (this *Loggers) Init(syslog *Syslog) error {
 	return nil
 }
 
+// SetIDs includes the run and operation correlation IDs in the prefix of
+// subsequent entries in every log. An empty operation ID is omitted.
+func (this *Loggers) SetIDs(run, op string) {
+	for _, logger := range this.Logger {
+		logger.SetIDs(run, op)
+	}
+}
+
 // Logger is a log.Logger object with embedded configuration and
 // multiwriter capabilities.
 type Logger struct {
@@ -78,6 +90,7 @@ type Logger struct {
 	Console bool
 	Syslog bool
 	Prefix []string
+	tag string
 }
 
 // Init initializes the Logger with embedded properties and parameters.
@@ -95,7 +108,7 @@ func (this *Logger) Init(tag string, syslog *Syslog) error {
 	}
 
 	if this.Console {
-		writers = append(writers, os.Stdout)
+		writers = append(writers, LogConsole)
 	}
 
 	if this.Syslog && syslog != nil {
@@ -110,7 +123,19 @@ func (this *Logger) Init(tag string, syslog *Syslog) error {
 		flags |= LogFlags[flag]
 	}
 
+	this.tag = tag
 	this.Logger = log.New(io.MultiWriter(writers...), tag, flags)
 
 	return nil
 }
+
+// SetIDs includes the run and operation correlation IDs in the prefix of
+// subsequent log entries. An empty operation ID is omitted.
+func (this *Logger) SetIDs(run, op string) {
+
+	if op == `` {
+		this.SetPrefix(fmt.Sprintf(`%srun=%s `, this.tag, run))
+	} else {
+		this.SetPrefix(fmt.Sprintf(`%srun=%s op=%s `, this.tag, run, op))
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	`io/ioutil`
+	`strings`
+)
+
+// machineID returns the systemd or D-Bus machine ID, or an empty string
+// if neither is present.
+func machineID() (string) {
+
+	for _, fn := range []string{`/etc/machine-id`, `/var/lib/dbus/machine-id`} {
+		if b, err := ioutil.ReadFile(fn); err == nil {
+			return strings.TrimSpace(string(b))
+		}
+	}
+
+	return ``
+}
@@ -0,0 +1,55 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`syscall`
+	`unsafe`
+)
+
+// machineID returns the Windows installation GUID, or an empty string if
+// it cannot be read.
+func machineID() (string) {
+
+	var (
+		key syscall.Handle
+		typ, n uint32
+	)
+
+	path, _ := syscall.UTF16PtrFromString(`SOFTWARE\Microsoft\Cryptography`)
+	name, _ := syscall.UTF16PtrFromString(`MachineGuid`)
+
+	const wow64Key = 0x0100 // KEY_WOW64_64KEY
+
+	if err := syscall.RegOpenKeyEx(syscall.HKEY_LOCAL_MACHINE, path, 0,
+		syscall.KEY_READ|wow64Key, &key); err != nil {
+		return ``
+	}
+
+	defer syscall.RegCloseKey(key)
+
+	if err := syscall.RegQueryValueEx(key, name, nil, &typ, nil, &n); err != nil || n == 0 {
+		return ``
+	}
+
+	buf := make([]uint16, n/2)
+
+	if err := syscall.RegQueryValueEx(key, name, nil, &typ,
+		(*byte)(unsafe.Pointer(&buf[0])), &n); err != nil {
+		return ``
+	}
+
+	return syscall.UTF16ToString(buf)
+}
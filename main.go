@@ -15,9 +15,15 @@
 package main
 
 import (
+	`context`
+	`encoding/json`
+	`errors`
+	`fmt`
 	`log`
 	`os`
+	`os/signal`
 	`strings`
+	`syscall`
 	`github.com/google/gousb`
 )
 
@@ -34,7 +40,7 @@ func main() {
 
 	if len(os.Args) < 2 {
 		fsAction.Usage()
-		os.Exit(1)
+		os.Exit(ExitConfig)
 	}
 
 	fsAction.Parse(os.Args[1:2])
@@ -43,42 +49,228 @@ func main() {
 
 	case *fActionVersion:
                 displayVersion()
-                os.Exit(0)
+                os.Exit(ExitSuccess)
 
 	case *fActionSerial:
 		if fsSerial.Parse(os.Args[2:]); fsSerial.NFlag() == 0 {
 			fsSerial.Usage()
-			os.Exit(1)
+			os.Exit(ExitConfig)
+		}
+
+	case *fActionCheckin:
+		fsCheckin.Parse(os.Args[2:])
+
+	case *fActionSetCredentials:
+		fsCredentials.Parse(os.Args[2:])
+
+	case *fActionFakeServer:
+		fsFakeServer.Parse(os.Args[2:])
+
+	case *fActionImportIDs:
+		if fsImportIDs.Parse(os.Args[2:]); *fImportIDsFrom == `` {
+			fsImportIDs.Usage()
+			os.Exit(ExitConfig)
 		}
 
 	case *fActionReport:
 		if fsReport.Parse(os.Args[2:]); fsReport.NFlag() == 0 {
 			fsReport.Usage()
-			os.Exit(1)
+			os.Exit(ExitConfig)
 		}
+
+	default:
+		fsGlobal.Parse(os.Args[2:])
+	}
+
+	// Keep stdout for device results if requested.
+
+	if err := validOutput(*fGlobalOutput); err != nil {
+		log.Print(err)
+		os.Exit(ExitConfig)
+	} else if *fGlobalOutput != `` {
+		status.Output, status.Writer = *fGlobalOutput, os.Stdout
+		LogConsole, Console = os.Stderr, os.Stderr
 	}
 
 	// Build system-wide configuration from config file.
 
-	if conf, err = newConfig(configFile); err != nil {
-		log.Fatal(err)
+	cfs, err := configFiles(configFile, *fGlobalConfig)
+
+	if err != nil {
+		log.Print(err)
+		os.Exit(ExitConfig)
+	}
+
+	if conf, err = newConfig(cfs...); err != nil {
+		log.Print(err)
+		os.Exit(ExitConfig)
 	}
 
 	// Write command line action and options to system log.
 
 	sl.Printf(`command action and options selected: %s`,
-		strings.Join(os.Args[1:], ` `),
+		strings.Join(redactArgs(os.Args[1:]), ` `),
 	)
 
+	// Record HTTP exchanges if requested.
+
+	if *fGlobalTrace != `` {
+		tracer = newTracer(httpClient.Transport, *fGlobalTrace)
+		httpClient.Transport = tracer
+	}
+
+	// Discard cached metadata if requested.
+
+	if *fGlobalRefreshMeta {
+		if err := conf.MetaCache.Clear(); err != nil {
+			el.Print(err)
+		}
+	}
+
+	// Save encrypted credentials and exit.
+
+	if *fActionSetCredentials {
+		err := setCredentials(conf.Server.Auth.EncryptedFile)
+		endRun(errorCode(err), err)
+	}
+
+	// Create a context that is cancelled when the run deadline passes or
+	// the process is interrupted, so that in-flight requests are abandoned
+	// and devices are still closed on the way out.
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *fGlobalTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *fGlobalTimeout)
+		defer cancel()
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case s := <-sig:
+			el.Printf(`received signal '%s', cancelling run`, s)
+			signal.Stop(sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// Run a fake cmdbd server until interrupted and exit.
+
+	if *fActionFakeServer {
+
+		addr := `:8080`
+
+		if fsFakeServer.NArg() > 0 {
+			addr = fsFakeServer.Arg(0)
+		}
+
+		err := runFakeServer(ctx, addr, *fFakeServerStore)
+		endRun(errorCode(err), err)
+	}
+
+	// Import a newer USB ID database and exit.
+
+	if *fActionImportIDs {
+
+		if conf.UsbIDs.File == `` {
+			endRun(ExitConfig, errors.New(`no USB ID database file configured`))
+		}
+
+		err := importUsbIDs(ctx, *fImportIDsFrom, conf.UsbIDs.File)
+		endRun(errorCode(err), err)
+	}
+
+	// Determine server capabilities and select the API version for actions
+	// that contact the server. Other actions use the default endpoints for
+	// any metadata lookups.
+
+	_, online := backend.(*restBackend)
+
+	if *fActionFlush || *fActionServerInfo || (online && (*fActionCheckin || *fActionAudit || *fSerialFetch)) {
+		if si, err := negotiate(ctx); err != nil {
+			el.Printf(`server capabilities unknown, using API %s - %v`, si.API, err)
+		}
+	}
+
+	if *fActionServerInfo {
+
+		b, err := json.MarshalIndent(servers.Info(), ``, `  `)
+
+		if err == nil {
+			fmt.Fprintln(Console, string(b))
+		}
+
+		endRun(errorCode(err), err)
+	}
+
+	// Deliver submissions spooled during previous runs before new ones.
+
+	if *fActionFlush || (online && (*fActionCheckin || *fActionAudit)) {
+
+		n, r, err := spool.Flush(ctx)
+
+		if n > 0 {
+			sl.Printf(`delivered %d spooled submissions`, n)
+		}
+
+		if r > 0 {
+			el.Printf(`%d spooled submissions not accepted, set aside in %s`, r, spool.Dir)
+		}
+
+		if err != nil && *fActionFlush {
+			endRun(errorCode(err), err)
+		} else if err != nil {
+			el.Print(err)
+		}
+	}
+
+	// Synchronize the local store with the server.
+
+	if fb, ok := backend.(*fileBackend); ok && *fActionFlush {
+
+		n, r, err := fb.Sync(ctx)
+
+		if n > 0 {
+			sl.Printf(`delivered %d submissions from %s`, n, fb.Dir)
+		}
+
+		if r > 0 {
+			el.Printf(`%d submissions from %s not accepted, set aside in %s`, r, fb.Dir, fb.Outbox.Dir)
+		}
+
+		if err != nil {
+			endRun(errorCode(err), err)
+		}
+	}
+
+	if *fActionFlush {
+		endRun(ExitSuccess, nil)
+	}
+
+	// Write device results and exit with a code reflecting the outcome for
+	// each device once the devices and context below have been closed.
+
+	defer func() {
+		if err := status.Flush(); err != nil {
+			el.Print(err)
+		}
+		os.Exit(status.Code())
+	}()
+
 	// Instantiate context to enumerate devices.
 
-	ctx := gousb.NewContext()
-	ctx.Debug(conf.DebugLevel)
-	defer ctx.Close()
+	uctx := gousb.NewContext()
+	uctx.Debug(conf.DebugLevel)
+	defer uctx.Close()
 
 	// Open devices that match selection criteria.
 
-	devs, err := ctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
+	devs, err := uctx.OpenDevices(func(desc *gousb.DeviceDesc) bool {
 
 		vid, pid := desc.Vendor.String(), desc.Product.String()
 
@@ -98,19 +290,101 @@ func main() {
 	// Exit if no devices found.
 
 	if len(devs) == 0 {
-		el.Fatalf(`no devices found`)
+		el.Print(`no devices found`)
+		return
+	}
+
+	for _, dev := range devs {
+		defer dev.Close()
 	}
 
 	// Pass each device to router.
 
+	var (
+		pending []*DeviceResult
+		ops []string
+	)
+
 	for _, dev := range devs {
 
-		defer dev.Close()
+		res := status.Begin(dev.Desc.Vendor.String(), dev.Desc.Product.String())
+
+		if ctx.Err() != nil {
+			el.Printf(`device %s-%s skipped - %v`, dev.Desc.Vendor, dev.Desc.Product, ctx.Err())
+			status.Skip(res, ctx.Err())
+			continue
+		}
+
+		octx := startOp(ctx)
 
 		sl.Printf(`found device %s-%s`, dev.Desc.Vendor, dev.Desc.Product)
 
-		if err = route(dev); err != nil {
+		n := len(batch)
+
+		if err = route(octx, dev); err != nil {
+			el.Print(err)
+		}
+
+		// Batched devices are recorded after the batch checkin.
+
+		if len(batch) == n {
+			status.Record(res, err)
+		} else {
+			pending = append(pending, status.Defer(res))
+			ops = append(ops, opID(octx))
+		}
+
+		endOp()
+	}
+
+	// Check in devices collected for a batch checkin.
+
+	if len(batch) > 0 {
+		checkinPending(ctx, pending, ops)
+	}
+}
+
+// checkinPending checks in the devices collected for a batch checkin under
+// a new operation. The operation that collected each device is logged with
+// the batch operation, and the outcome for each device is logged under the
+// operation that collected it.
+func checkinPending(ctx context.Context, pending []*DeviceResult, ops []string) {
+
+	octx := startOp(ctx)
+
+	for i, dev := range batch {
+		sl.Printf(`device %s-%s-%s batched from operation %s`,
+			dev.VID(), dev.PID(), dev.SN(), ops[i],
+		)
+	}
+
+	errs := backend.CheckinBatch(octx, batch)
+
+	for i, err := range errs {
+		resumeOp(ops[i])
+		if err != nil {
 			el.Print(err)
 		}
+		status.Record(pending[i], err)
 	}
+
+	endOp()
+}
+
+// endRun ends a run that does not process devices. It logs the error that
+// ended the run, if any, writes the summary of the run, and exits with the
+// given code.
+func endRun(code int, err error) {
+
+	if err != nil {
+		el.Print(err)
+	}
+
+	status.End(code, err)
+
+	if err := status.Flush(); err != nil {
+		el.Print(err)
+	}
+
+	os.Exit(status.Code())
 }
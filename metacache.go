@@ -0,0 +1,145 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`encoding/json`
+	`errors`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`time`
+)
+
+// errUnknownID indicates that the server has no metadata for an ID.
+var errUnknownID = errors.New(`unknown ID`)
+
+// MetaCache is a persistent cache of USB metadata lookups shared across
+// runs. Names found on the server are kept for TTL hours; IDs the server
+// does not know are remembered for NegativeTTL hours so that they are not
+// looked up again on every run.
+type MetaCache struct {
+	File string				// Cache file; blank for no persistence
+	TTL time.Duration			// Lifetime of cached names
+	NegativeTTL time.Duration		// Lifetime of cached unknown IDs
+	entries map[string]*metaEntry
+}
+
+// metaEntry is the cached result of a single metadata lookup.
+type metaEntry struct {
+	Name string
+	Found bool
+	Expires time.Time
+}
+
+// Init converts settings to runtime units and loads unexpired entries
+// from the cache file.
+func (this *MetaCache) Init() (error) {
+
+	this.TTL *= time.Hour
+	this.NegativeTTL *= time.Hour
+	this.entries = make(map[string]*metaEntry)
+
+	if this.File == `` {
+		return nil
+	}
+
+	this.File = filePath(this.File)
+
+	if _, err := makePath(filepath.Dir(this.File)); err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(this.File); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := loadConfig(&this.entries, this.File); err != nil {
+		el.Printf(`metadata cache %s unreadable, starting empty - %v`, this.File, err)
+		this.entries = make(map[string]*metaEntry)
+	}
+
+	for key, me := range this.entries {
+		if time.Now().After(me.Expires) {
+			delete(this.entries, key)
+		}
+	}
+
+	return nil
+}
+
+// Lookup returns the cached name for the key. On a cache miss it calls
+// fetch and caches the result: a name if found, or the fact that the ID is
+// unknown if fetch fails with errUnknownID. Other errors are not cached.
+func (this *MetaCache) Lookup(key string, fetch func() (string, error)) (string, error) {
+
+	if me, ok := this.entries[key]; ok && time.Now().Before(me.Expires) {
+		if !me.Found {
+			return ``, errUnknownID
+		}
+		return me.Name, nil
+	}
+
+	s, err := fetch()
+
+	switch {
+
+	case err == nil && this.TTL > 0:
+		this.entries[key] = &metaEntry{s, true, time.Now().Add(this.TTL)}
+
+	case errors.Is(err, errUnknownID) && this.NegativeTTL > 0:
+		this.entries[key] = &metaEntry{``, false, time.Now().Add(this.NegativeTTL)}
+
+	default:
+		return s, err
+	}
+
+	if serr := this.save(); serr != nil {
+		el.Printf(`metadata cache %s not saved - %v`, this.File, serr)
+	}
+
+	return s, err
+}
+
+// Clear discards all cached entries.
+func (this *MetaCache) Clear() (error) {
+
+	this.entries = make(map[string]*metaEntry)
+
+	if this.File == `` {
+		return nil
+	}
+
+	if err := os.Remove(this.File); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	sl.Printf(`metadata cache %s cleared`, this.File)
+	return nil
+}
+
+// save writes the cache to the cache file.
+func (this *MetaCache) save() (error) {
+
+	if this.File == `` {
+		return nil
+	}
+
+	if b, err := json.Marshal(this.entries); err != nil {
+		return err
+	} else {
+		return ioutil.WriteFile(this.File, b, FileMode)
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`context`
+	`fmt`
+	`io/ioutil`
+	`net/http`
+	`net/url`
+	`strings`
+	`time`
+)
+
+// Authentication modes.
+const (
+	AuthBasic = `basic`
+	AuthOAuth2 = `oauth2`
+)
+
+// EnvClientSecret is the environment variable that overrides the OAuth2
+// client secret in the configuration file.
+const EnvClientSecret = `CMDBC_CLIENT_SECRET`
+
+// tokenSkew is how long before its expiry a bearer token is refreshed.
+const tokenSkew = 30 * time.Second
+
+// OAuth2 holds the settings for the OAuth2 client credentials grant and
+// caches the bearer token obtained with it.
+type OAuth2 struct {
+	TokenURL string				// Token endpoint of the identity provider
+	ClientID string				// Client ID; defaults to Auth username
+	ClientSecret string			// Client secret; required
+	Scopes []string				// Scopes requested
+	token string
+	expires time.Time
+}
+
+// tokenResponse is the token endpoint response, or its error response.
+type tokenResponse struct {
+	AccessToken string			`json:"access_token"`
+	TokenType string			`json:"token_type"`
+	ExpiresIn int				`json:"expires_in"`
+	Error string				`json:"error"`
+	ErrorDescription string			`json:"error_description"`
+}
+
+// Token returns the cached bearer token, first obtaining a new one from
+// the token endpoint if there is none or it is about to expire. The token
+// endpoint is reached with its own client, so the server's TLS settings,
+// cookies, request headers, and signing do not apply to it; the exchange
+// is recorded in the trace, if any, with the client secret and token
+// redacted. A request the identity provider refuses is reported as an
+// authError.
+func (this *OAuth2) Token(ctx context.Context) (string, error) {
+
+	if this.token != `` && (this.expires.IsZero() || time.Now().Add(tokenSkew).Before(this.expires)) {
+		return this.token, nil
+	}
+
+	form := url.Values{`grant_type`: {`client_credentials`}}
+
+	if len(this.Scopes) > 0 {
+		form.Set(`scope`, strings.Join(this.Scopes, ` `))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, this.TokenURL,
+		strings.NewReader(form.Encode()),
+	)
+
+	if err != nil {
+		return ``, err
+	}
+
+	req.Header.Set(`Content-Type`, `application/x-www-form-urlencoded`)
+	req.SetBasicAuth(url.QueryEscape(this.ClientID), url.QueryEscape(this.ClientSecret))
+
+	var tr tokenResponse
+
+	if hr, err := tokenRequest(req); err != nil {
+		return ``, err
+	} else if err := hr.Content().Decode(&tr); undeliverable(hr, nil) {
+		return ``, fmt.Errorf(`token request failed - %w`, hr.Err())
+	} else if hr.Status().Rejected() {
+		if tr.Error != `` {
+			return ``, &authError{fmt.Errorf(`token request failed - %s: %s %s`, hr.Status(), tr.Error, tr.ErrorDescription)}
+		}
+		return ``, &authError{fmt.Errorf(`token request failed - %w`, hr.Err())}
+	} else if err != nil {
+		return ``, err
+	} else if tr.AccessToken == `` || !strings.EqualFold(tr.TokenType, `bearer`) {
+		return ``, fmt.Errorf(`token request failed - no bearer token in response`)
+	}
+
+	this.token = tr.AccessToken
+	this.expires = time.Time{}
+
+	if tr.ExpiresIn > 0 {
+		this.expires = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+
+	sl.Printf(`bearer token obtained, expires in %ds`, tr.ExpiresIn)
+	return this.token, nil
+}
+
+// tokenRequest sends a request to the token endpoint and reads the response.
+// The X-Run-ID and X-Request-ID headers are deliberately not sent, since
+// the identity provider is not part of the CMDB service and has no use for
+// them.
+func tokenRequest(req *http.Request) (*httpResult, error) {
+
+	hc, err := externalClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if tracer != nil {
+		hc.Transport = tracer.Via(hc.Transport)
+	}
+
+	sl.Printf(`token request %s %s`, req.Method, req.URL)
+
+	resp, err := hc.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	return &httpResult{httpStatus(resp.StatusCode), body, resp.Header}, err
+}
+
+// Reset discards the cached bearer token.
+func (this *OAuth2) Reset() {
+	this.token, this.expires = ``, time.Time{}
+}
+
+// authorize attaches the bearer token to a request in OAuth2 mode once
+// the client has authenticated. Requests carrying other credentials, such
+// as token requests, are left alone.
+func authorize(req *http.Request) (error) {
+
+	if conf.Server.Auth.Mode != AuthOAuth2 || !authenticated {
+		return nil
+	}
+
+	if h := req.Header.Get(`Authorization`); h != `` && !strings.HasPrefix(h, `Bearer `) {
+		return nil
+	}
+
+	if tok, err := conf.Server.Auth.OAuth2.Token(req.Context()); err != nil {
+		return err
+	} else {
+		req.Header.Set(`Authorization`, `Bearer ` + tok)
+		return nil
+	}
+}
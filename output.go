@@ -0,0 +1,223 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`encoding/json`
+	`fmt`
+	`io`
+	`os`
+	`strings`
+)
+
+// Formats of the device results written with the -output option.
+const (
+	OutputJSON = `json`
+	OutputNDJSON = `ndjson`
+)
+
+// Console receives the reports, device state, and server information
+// printed by the -console, -state, and -server-info options. It is moved
+// to stderr when stdout is kept for device results.
+var Console io.Writer = os.Stdout
+
+// Outcomes of the devices processed in a run.
+const (
+	OutcomeSuccess = `success`
+	OutcomeFailure = `failure`
+	OutcomeSkipped = `skipped`
+)
+
+// DeviceResult is the outcome of the action on one device.
+type DeviceResult struct {
+	VendorID string				`json:"vendor_id"`
+	ProductID string			`json:"product_id"`
+	SerialNum string			`json:"serial_number"`
+	Driver string				`json:"driver,omitempty"`
+	Action string				`json:"action"`
+	Outcome string				`json:"outcome"`
+	Error string				`json:"error,omitempty"`
+	Changes [][]string			`json:"changes,omitempty"`
+	ServerStatus int			`json:"server_status,omitempty"`
+}
+
+// runSummary is the summary of a run written after the device results.
+type runSummary struct {
+	Devices int				`json:"devices"`
+	Succeeded int				`json:"succeeded"`
+	Failed int				`json:"failed"`
+	Skipped int				`json:"skipped"`
+	AuthFailed int				`json:"auth_failed"`
+	Changed int				`json:"changed"`
+	ExitCode int				`json:"exit_code"`
+	Error string				`json:"error,omitempty"`
+}
+
+// validOutput returns an error if the -output format is not supported.
+func validOutput(format string) (error) {
+
+	switch format {
+	case ``, OutputJSON, OutputNDJSON:
+		return nil
+	}
+
+	return fmt.Errorf(`unsupported output format '%s'`, format)
+}
+
+// Begin adds a device to the run and makes it the current device, whose
+// result is completed as the action proceeds.
+func (this *runStatus) Begin(vid, pid string) (*DeviceResult) {
+
+	res := &DeviceResult{VendorID: vid, ProductID: pid, Action: actionName()}
+
+	this.Results = append(this.Results, res)
+	this.current = res
+
+	return res
+}
+
+// Describe fills in the serial number and driver type of the current
+// device from its driver object.
+func (this *runStatus) Describe(i interface{}) {
+
+	if this.current == nil {
+		return
+	}
+
+	if d, ok := i.(interface{ SN() string }); ok {
+		this.current.SerialNum = d.SN()
+	}
+
+	t := strings.TrimLeft(fmt.Sprintf(`%T`, i), `*`)
+	this.current.Driver = strings.ToLower(t[strings.LastIndex(t, `.`) + 1:])
+}
+
+// Response notes the server status of an accepted request for the current
+// device. The status of a rejected request is taken from its error.
+func (this *runStatus) Response(stat httpStatus) {
+
+	if this.current != nil {
+		this.current.ServerStatus = int(stat)
+	}
+}
+
+// Defer leaves the outcome of a device to be recorded later, such as after
+// a batch checkin, and returns its result.
+func (this *runStatus) Defer(res *DeviceResult) (*DeviceResult) {
+
+	if this.current == res {
+		this.current = nil
+	}
+
+	return res
+}
+
+// Summary returns the summary of the run.
+func (this *runStatus) Summary() (runSummary) {
+
+	return runSummary{
+		Devices: this.Devices,
+		Succeeded: this.Devices - this.Failed - this.Skipped,
+		Failed: this.Failed,
+		Skipped: this.Skipped,
+		AuthFailed: this.AuthFailed,
+		Changed: this.Changed,
+		ExitCode: this.Code(),
+		Error: this.err,
+	}
+}
+
+// finish completes the result of a device. In ndjson format the result is
+// written immediately.
+func (this *runStatus) finish(res *DeviceResult) {
+
+	this.Defer(res)
+
+	if this.Output == OutputNDJSON {
+		this.write(struct {
+			Device *DeviceResult	`json:"device"`
+		}{res})
+	}
+}
+
+// Flush writes the summary of the run and, in json format, the results of
+// every device.
+func (this *runStatus) Flush() (error) {
+
+	switch this.Output {
+
+	case OutputJSON:
+
+		res := this.Results
+
+		if res == nil {
+			res = []*DeviceResult{}
+		}
+
+		return this.write(struct {
+			Devices []*DeviceResult	`json:"devices"`
+			Summary runSummary	`json:"summary"`
+		}{res, this.Summary()})
+
+	case OutputNDJSON:
+
+		return this.write(struct {
+			Summary runSummary	`json:"summary"`
+		}{this.Summary()})
+	}
+
+	return nil
+}
+
+// write writes an object to Writer, indented in json format and on one
+// line in ndjson format.
+func (this *runStatus) write(v interface{}) (error) {
+
+	enc := json.NewEncoder(this.Writer)
+
+	if this.Output == OutputJSON {
+		enc.SetIndent(``, `  `)
+	}
+
+	return enc.Encode(v)
+}
+
+// actionName returns the name of the action applied to devices, in the
+// order of precedence used by route.
+func actionName() (string) {
+
+	switch {
+
+	case *fActionSerial:
+		return `serial`
+
+	case *fActionState:
+		return `state`
+
+	case *fActionReport:
+		return `report`
+
+	case *fActionCheckin:
+		return `checkin`
+
+	case *fActionAudit:
+		return `audit`
+
+	case *fActionReset:
+		return `reset`
+	}
+
+	return ``
+}
@@ -0,0 +1,145 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`fmt`
+	`net`
+	`net/http`
+	`net/url`
+	`strings`
+	`time`
+)
+
+// Proxy holds the settings for reaching the server through a forward proxy.
+type Proxy struct {
+	URL string				// URL of the proxy server
+	Username string				// Username for proxy authentication
+	Password string				// Password for proxy authentication
+	NoProxy []string			// Hosts, domains, and networks reached directly
+	UseEnvironment bool			// Use HTTP_PROXY, HTTPS_PROXY, and NO_PROXY
+}
+
+// Func returns the function the HTTP transport uses to select a proxy for
+// each request, or nil if requests should not be proxied.
+func (this *Proxy) Func() (func(*http.Request) (*url.URL, error), error) {
+
+	if this.UseEnvironment {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	if this.URL == `` {
+		return nil, nil
+	}
+
+	pu, err := url.Parse(this.URL)
+
+	if err != nil {
+		return nil, fmt.Errorf(`invalid proxy URL - %v`, err)
+	} else if pu.Host == `` {
+		return nil, fmt.Errorf(`invalid proxy URL '%s' - no host`, this.URL)
+	}
+
+	if this.Username != `` {
+		pu.User = url.UserPassword(this.Username, this.Password)
+	}
+
+	return func(req *http.Request) (*url.URL, error) {
+		if this.Bypass(req.URL) {
+			return nil, nil
+		}
+		return pu, nil
+	}, nil
+}
+
+// externalClient returns an HTTP client for hosts other than the cmdbd
+// server, such as download sites and identity providers. It uses the proxy
+// settings and timeout of the client, but not the server's TLS settings
+// or session cookies, which apply only to the server. It does not record
+// exchanges in the HTTP trace unless the caller adds the trace to it.
+func externalClient() (*http.Client, error) {
+
+	tr := &http.Transport{
+		IdleConnTimeout: conf.Client.IdleConnTimeout * time.Second,
+		ResponseHeaderTimeout: conf.Client.ResponseHeaderTimeout * time.Second,
+	}
+
+	if conf.Client.Proxy != nil {
+		if pf, err := conf.Client.Proxy.Func(); err != nil {
+			return nil, err
+		} else {
+			tr.Proxy = pf
+		}
+	}
+
+	return &http.Client{Timeout: conf.Client.Timeout * time.Second, Transport: tr}, nil
+}
+
+// Bypass returns true if the URL matches an entry in the NoProxy list.
+// Entries follow the NO_PROXY convention: '*' matches every host, a domain
+// matches itself and its subdomains, an IP address or CIDR block matches
+// addresses within it, and any entry may be qualified with a port.
+func (this *Proxy) Bypass(u *url.URL) (bool) {
+
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+
+	if port == `` {
+		if u.Scheme == `https` {
+			port = `443`
+		} else {
+			port = `80`
+		}
+	}
+
+	ip := net.ParseIP(host)
+
+	for _, entry := range this.NoProxy {
+
+		entry = strings.ToLower(strings.TrimSpace(entry))
+
+		if entry == `*` {
+			return true
+		}
+
+		if _, ipnet, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && ipnet.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+
+		if eip := net.ParseIP(entry); eip != nil {
+			if ip != nil && eip.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		entry = strings.TrimPrefix(strings.TrimPrefix(entry, `*`), `.`)
+
+		if host == entry || strings.HasSuffix(host, `.` + entry) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,157 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`errors`
+	`fmt`
+	`math/rand`
+	`net`
+	`net/http`
+	`strconv`
+	`time`
+)
+
+// Retry is the policy for resending API calls that fail because of
+// connection errors or transient server conditions.
+type Retry struct {
+	MaxAttempts int				// Attempts per request, including the first
+	BaseBackoff time.Duration		// Delay before the first retry
+	MaxBackoff time.Duration		// Upper limit on delay between retries
+	Jitter float64				// Fraction of each delay to randomize
+}
+
+// Init validates the retry policy and converts its settings to runtime units.
+func (this *Retry) Init() error {
+
+	if this.Jitter < 0 || this.Jitter > 1 {
+		return fmt.Errorf(`retry jitter %v not between 0 and 1`, this.Jitter)
+	}
+
+	if this.MaxAttempts < 1 {
+		this.MaxAttempts = 1
+	}
+
+	this.BaseBackoff *= time.Second
+	this.MaxBackoff *= time.Second
+
+	if this.MaxBackoff < this.BaseBackoff {
+		this.MaxBackoff = this.BaseBackoff
+	}
+
+	return nil
+}
+
+// Retryable returns true if a failed attempt may be sent again. Requests
+// with idempotent methods are retried after any connection error and after
+// 5xx and 429 responses. Other requests, such as POSTs, are only retried when
+// the server could not have processed them: the connection was never made
+// or the server explicitly deferred the request.
+func (this *Retry) Retryable(req *http.Request, resp *http.Response, err error) (bool) {
+
+	if err != nil {
+		return idempotent(req) || dialError(err)
+	}
+
+	switch code := resp.StatusCode; {
+
+	case code == http.StatusTooManyRequests:
+		return true
+
+	case code == http.StatusServiceUnavailable && resp.Header.Get(`Retry-After`) != ``:
+		return true
+
+	case code >= http.StatusInternalServerError:
+		return idempotent(req)
+	}
+
+	return false
+}
+
+// Delay returns the time to wait before the given retry, where the first
+// retry is 1. A Retry-After header in the response takes precedence over
+// the computed exponential backoff. Either delay is limited to MaxBackoff,
+// so that a server cannot stall the client indefinitely.
+func (this *Retry) Delay(retry int, resp *http.Response) (time.Duration) {
+
+	if resp != nil {
+		if d, ok := retryAfter(resp.Header.Get(`Retry-After`)); ok {
+			if d > this.MaxBackoff {
+				d = this.MaxBackoff
+			}
+			return d
+		}
+	}
+
+	d := this.BaseBackoff
+
+	for i := 1; i < retry && d < this.MaxBackoff; i++ {
+		d *= 2
+	}
+
+	if d > this.MaxBackoff {
+		d = this.MaxBackoff
+	}
+
+	if this.Jitter > 0 && d > 0 {
+		d -= time.Duration(rand.Float64() * this.Jitter * float64(d))
+	}
+
+	return d
+}
+
+// retryAfter parses the value of a Retry-After header, which may be either
+// a number of seconds or an HTTP date.
+func retryAfter(s string) (time.Duration, bool) {
+
+	if s == `` {
+		return 0, false
+	}
+
+	if n, err := strconv.Atoi(s); err == nil && n >= 0 {
+		return time.Duration(n) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// idempotent returns true if the request method can safely be repeated.
+func idempotent(req *http.Request) (bool) {
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodHead:
+	case http.MethodOptions:
+	case http.MethodPut:
+	case http.MethodDelete:
+	default: return false
+	}
+
+	return true
+}
+
+// dialError returns true if the error occurred while establishing the
+// connection, before any part of the request was sent.
+func dialError(err error) (bool) {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == `dial`
+}
@@ -15,25 +15,35 @@
 package main
 
 import (
+	`context`
+	`errors`
 	`fmt`
 	`github.com/google/gousb`
 	`github.com/jscherff/cmdb/ci/peripheral/usb`
 )
 
-func route(i interface{}) (err error) {
+// batch holds devices collected for a batch checkin.
+var batch []usb.Reporter
+
+func route(ctx context.Context, i interface{}) (err error) {
+
+	var cn *Classes
+
+	desc := descriptor(i)
 
 	if i, err = convert(i); err != nil {
 		return err
 	}
 
-	i = update(i)
+	i, cn = update(ctx, i, desc)
+	status.Describe(i)
 
 	if d, ok := i.(usb.Serializer); ok {
 
 		switch {
 
 		case *fActionSerial:
-			if err = serial(d); err != nil {
+			if err = serial(ctx, d); err != nil {
 				return err
 			}
 			*fActionReset = true
@@ -53,16 +63,23 @@ func route(i interface{}) (err error) {
 
 	if d, ok := i.(usb.Auditer); ok {
 
+		if cn != nil {
+			d = &classified{d, cn}
+		}
+
 		switch {
 
 		case *fActionReport:
 			err = report(d)
 
+		case *fActionCheckin && *fCheckinBatch:
+			batch = append(batch, d)
+
 		case *fActionCheckin:
-			err = checkin(d)
+			err = backend.Checkin(ctx, d)
 
 		case *fActionAudit:
-			err = audit(d)
+			err = audit(ctx, d)
 
 		case *fActionReset:
 			err = d.Reset()
@@ -115,25 +132,108 @@ func convert(i interface{}) (interface{}, error) {
 	}
 }
 
-func update(i interface{}) (interface{}) {
+// update fills in missing vendor and product names and resolves the names
+// of the classes in the device descriptor, if available.
+func update(ctx context.Context, i interface{}, desc *gousb.DeviceDesc) (interface{}, *Classes) {
 
 	d, ok := i.(usb.Updater)
 
 	if !ok {
-		return i
+		return i, classify(ctx, desc)
 	}
 
 	if d.GetVendorName() == `` {
-		if s, err := vendor(d); err == nil {
+
+		s, err := resolve(
+
+			func() (string, bool) {
+				return usbIDs.Vendor(d.VID())
+			},
+
+			func() (string, error) {
+				return conf.MetaCache.Lookup(`vendor/` + d.VID(), func() (string, error) {
+					return backend.Vendor(ctx, d)
+				})
+			},
+		)
+
+		if err == nil {
 			d.SetVendorName(s)
 		}
 	}
 
 	if d.GetProductName() == `` {
-		if s, err := product(d); err == nil {
+
+		s, err := resolve(
+
+			func() (string, bool) {
+				return usbIDs.Product(d.VID(), d.PID())
+			},
+
+			func() (string, error) {
+				return conf.MetaCache.Lookup(`product/` + d.VID() + `/` + d.PID(), func() (string, error) {
+					return backend.Product(ctx, d)
+				})
+			},
+		)
+
+		if err == nil {
 			d.SetProductName(s)
 		}
 	}
 
-	return i
+	return i, classify(ctx, desc)
+}
+
+// metaOffline is set once a server lookup fails for a reason other than an
+// unknown ID. Such failures are not cached, so the rest of the run uses
+// only the local USB ID database rather than waiting on the server again.
+var metaOffline bool
+
+// resolve looks up a name in the local USB ID database and on the server,
+// in the order selected by the configuration, and returns the first found.
+// After the first failed server lookup, only the database is used.
+func resolve(local func() (string, bool), remote func() (string, error)) (string, error) {
+
+	if usbIDs == nil {
+		return remote()
+	}
+
+	if metaOffline {
+		if s, ok := local(); ok {
+			return s, nil
+		}
+		return ``, fmt.Errorf(`lookup skipped - server unavailable earlier in run`)
+	}
+
+	if conf.UsbIDs.Mode == `primary` {
+		if s, ok := local(); ok {
+			return s, nil
+		}
+		return remoteLookup(remote)
+	}
+
+	s, err := remoteLookup(remote)
+
+	if err != nil {
+		if ls, ok := local(); ok {
+			return ls, nil
+		}
+	}
+
+	return s, err
+}
+
+// remoteLookup looks up a name on the server and notes whether the server
+// could not provide an answer.
+func remoteLookup(remote func() (string, error)) (string, error) {
+
+	s, err := remote()
+
+	if err != nil && !errors.Is(err, errUnknownID) {
+		el.Printf(`%v - using USB ID database for the rest of the run`, err)
+		metaOffline = true
+	}
+
+	return s, err
 }
@@ -0,0 +1,194 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`context`
+	`fmt`
+	`net/http`
+	`regexp`
+	`strconv`
+	`strings`
+)
+
+// DefaultAPI is the API version of the Endpoints setting, used with
+// servers that do not report the versions they support.
+const DefaultAPI = `v2`
+
+// Server features the client can use when available.
+const (
+	FeatureBatchCheckin = `batch_checkin`
+	FeatureConditionalCheckin = `conditional_checkin`
+)
+
+// ServerInfo describes the capabilities reported by a server on the
+// cmdb_info endpoint and the API version selected for it.
+type ServerInfo struct {
+	Version string				`json:"version"`
+	APIVersions []string			`json:"api_versions"`
+	Features []string			`json:"features"`
+	API string				`json:"selected_api"`
+	endpoints map[string]string
+}
+
+// Supports returns true if the server reports the feature. Servers that
+// do not report their features are assumed to support it; the client
+// falls back if they do not.
+func (this *ServerInfo) Supports(feature string) (bool) {
+
+	if this == nil || this.Features == nil {
+		return true
+	}
+
+	for _, f := range this.Features {
+		if f == feature {
+			return true
+		}
+	}
+
+	return false
+}
+
+// negotiate selects the server to use, obtains its capabilities, and
+// selects the API version for it. The version is negotiated again with
+// each server the client fails over to, since servers may differ.
+func negotiate(ctx context.Context) (*ServerInfo, error) {
+
+	servers.Select(ctx)
+	servers.versioned = true
+
+	return servers.negotiate(ctx)
+}
+
+// serverInfo obtains the capabilities of a server and selects the newest
+// API version supported by both the server and the client configuration.
+// Endpoints missing from the selected version's endpoint set are taken
+// from the default set. Servers without an info endpoint are assumed to
+// support only the default API version. The request is not failed over,
+// so that the result applies to the given server.
+func serverInfo(ctx context.Context, sa *ServerAddr) (*ServerInfo, error) {
+
+	this := &ServerInfo{API: DefaultAPI}
+
+	if _, ok := conf.Server.Endpoints[`cmdb_info`]; !ok {
+		return this, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		sa.URL() + conf.Server.Endpoints[`cmdb_info`], nil,
+	)
+
+	if err != nil {
+		return this, err
+	}
+
+	hr, err := httpSend(req)
+
+	switch {
+
+	case err != nil:
+		return this, err
+
+	case hr.Status().Unsupported():
+		sl.Printf(`server %s does not report capabilities - %s, using API %s`, sa.Host(), hr.Status(), this.API)
+		return this, nil
+
+	case hr.Status().Rejected():
+		return this, fmt.Errorf(`server %s capabilities not retrieved - %w`, sa.Host(), hr.Err())
+	}
+
+	if err := hr.Content().Decode(this); err != nil {
+		return &ServerInfo{API: DefaultAPI}, err
+	}
+
+	this.API = DefaultAPI
+
+	for _, v := range this.APIVersions {
+		if _, ok := conf.Server.EndpointSets[v]; ok && apiNumber(v) > apiNumber(this.API) {
+			this.API = v
+		}
+	}
+
+	if this.API != DefaultAPI {
+
+		this.endpoints = make(map[string]string)
+
+		for k, v := range conf.Server.Endpoints {
+			this.endpoints[k] = v
+		}
+
+		for k, v := range conf.Server.EndpointSets[this.API] {
+			this.endpoints[k] = v
+		}
+	}
+
+	sl.Printf(`server %s version %s, using API %s, features: %s`,
+		sa.Host(), this.Version, this.API, strings.Join(this.Features, `, `),
+	)
+
+	return this, nil
+}
+
+// apiNumber returns the number of an API version such as 'v3', or zero.
+func apiNumber(v string) (int) {
+	n, _ := strconv.Atoi(strings.TrimPrefix(v, `v`))
+	return n
+}
+
+// rebase points a request made to a server using one endpoint set at the
+// same endpoint on the server now in use, whose API version may differ.
+func rebase(req *http.Request, from map[string]string) {
+
+	sa, to := servers.Current(), servers.Endpoints()
+
+	req.URL.Scheme = sa.Protocol
+	req.URL.Host = sa.Host()
+	req.Host = req.URL.Host
+
+	if key, params, ok := matchEndpoint(from, req.URL.Path); ok && from[key] != to[key] {
+		req.URL.Path = fmt.Sprintf(to[key], params...)
+		req.URL.RawPath = ``
+	}
+}
+
+// matchEndpoint returns the key of the endpoint in eps from which a path
+// was built and the parameters it was built with.
+func matchEndpoint(eps map[string]string, path string) (string, []interface{}, bool) {
+
+	for key, ep := range eps {
+
+		parts := strings.Split(ep, `%s`)
+
+		for i, p := range parts {
+			parts[i] = regexp.QuoteMeta(p)
+		}
+
+		m := regexp.MustCompile(`^` + strings.Join(parts, `([^/]*)`) + `$`).FindStringSubmatch(path)
+
+		if m == nil {
+			continue
+		}
+
+		params := make([]interface{}, len(m) - 1)
+
+		for i, p := range m[1:] {
+			params[i] = p
+		}
+
+		return key, params, true
+	}
+
+	return ``, nil, false
+}
@@ -0,0 +1,182 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`context`
+	`fmt`
+	`io`
+	`io/ioutil`
+	`net`
+	`net/http`
+)
+
+// ServerAddr is the network address of a cmdbd server.
+type ServerAddr struct {
+	Protocol string				// Protocol for server connections
+	HostName string				// Hostname or IP address of server
+	Port string				// TCP port on which server listens
+}
+
+// URL returns the base URL of the server.
+func (this *ServerAddr) URL() (string) {
+	return fmt.Sprintf(`%s://%s`, this.Protocol, this.Host())
+}
+
+// Host returns the host and port of the server.
+func (this *ServerAddr) Host() (string) {
+	return net.JoinHostPort(this.HostName, this.Port)
+}
+
+// ServerList is an ordered list of servers, primary first, and tracks the
+// server currently in use. Once a server has been found to work, it is
+// used for the rest of the run unless it fails. It also holds the
+// capabilities of each server with which the API version was negotiated.
+type ServerList struct {
+	addrs []*ServerAddr
+	infos []*ServerInfo
+	cur int
+	probed bool
+	versioned bool
+}
+
+// newServerList creates a server list from the primary server and its
+// alternates. Alternates inherit the protocol and port of the primary
+// server if they do not specify their own.
+func newServerList(primary *ServerAddr, alternates []*ServerAddr) (*ServerList) {
+
+	this := &ServerList{addrs: []*ServerAddr{primary}}
+
+	for _, sa := range alternates {
+
+		if sa.Protocol == `` {
+			sa.Protocol = primary.Protocol
+		}
+		if sa.Port == `` {
+			sa.Port = primary.Port
+		}
+
+		this.addrs = append(this.addrs, sa)
+	}
+
+	this.infos = make([]*ServerInfo, len(this.addrs))
+
+	return this
+}
+
+// Len returns the number of servers in the list.
+func (this *ServerList) Len() (int) {
+	return len(this.addrs)
+}
+
+// Current returns the server currently in use.
+func (this *ServerList) Current() (*ServerAddr) {
+	return this.addrs[this.cur]
+}
+
+// Info returns the capabilities of the server currently in use, or nil if
+// they have not been determined.
+func (this *ServerList) Info() (*ServerInfo) {
+	return this.infos[this.cur]
+}
+
+// Endpoints returns the endpoint set of the API version selected for the
+// server currently in use, or the default set if none was selected.
+func (this *ServerList) Endpoints() (map[string]string) {
+
+	if si := this.Info(); si != nil && si.endpoints != nil {
+		return si.endpoints
+	}
+
+	return conf.Server.Endpoints
+}
+
+// negotiate obtains the capabilities of the server currently in use and
+// selects its API version. If they cannot be obtained, the default API
+// version is used with the server.
+func (this *ServerList) negotiate(ctx context.Context) (*ServerInfo, error) {
+
+	si, err := serverInfo(ctx, this.Current())
+	this.infos[this.cur] = si
+
+	return si, err
+}
+
+// Next switches to the next server in the list, wrapping around to the
+// primary after the last alternate, and returns it.
+func (this *ServerList) Next() (*ServerAddr) {
+	this.cur = (this.cur + 1) % len(this.addrs)
+	return this.Current()
+}
+
+// Select probes the health endpoint of each server in order and switches
+// to the first that responds. It only probes once per run. If no server
+// responds, the current server remains selected.
+func (this *ServerList) Select(ctx context.Context) {
+
+	if this.probed || len(this.addrs) < 2 || conf.Server.Endpoints[`cmdb_health`] == `` {
+		this.probed = true
+		return
+	}
+
+	this.probed = true
+
+	for i := range this.addrs {
+
+		sa := this.addrs[(this.cur + i) % len(this.addrs)]
+
+		if err := this.probe(ctx, sa); err != nil {
+			el.Printf(`server %s health check failed - %v`, sa.Host(), err)
+			continue
+		}
+
+		this.cur = (this.cur + i) % len(this.addrs)
+		sl.Printf(`server %s selected`, sa.Host())
+		return
+	}
+}
+
+// probe checks whether a server is up. Any response other than a 5xx
+// error indicates that the server is able to process requests.
+func (this *ServerList) probe(ctx context.Context, sa *ServerAddr) (error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		sa.URL() + conf.Server.Endpoints[`cmdb_health`], nil,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	// Probes are not tied to a device and carry the run ID in both headers.
+
+	req.Header.Set(`X-Run-ID`, runID)
+	req.Header.Set(`X-Request-ID`, runID)
+
+	resp, err := httpClient.Do(req)
+
+	if err != nil {
+		return tlsError(req, err)
+	}
+
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf(`%s`, httpStatus(resp.StatusCode))
+	}
+
+	return nil
+}
@@ -0,0 +1,201 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`bytes`
+	`crypto/hmac`
+	`crypto/sha256`
+	`encoding/base64`
+	`encoding/hex`
+	`fmt`
+	`io/ioutil`
+	`net/http`
+	`os`
+	`strconv`
+	`strings`
+	`time`
+)
+
+// Request signing headers.
+const (
+	SignatureHeader = `X-Signature`
+	TimestampHeader = `X-Timestamp`
+	KeyIDHeader = `X-Key-ID`
+)
+
+// minKeyLen is the minimum length of a signing key in bytes.
+const minKeyLen = 32
+
+// Signing holds the settings for HMAC-SHA256 request signing. Each client
+// host has its own key, which the server looks up by the host name sent in
+// the X-Key-ID header. Requests are signed if a key file is configured.
+type Signing struct {
+	KeyFile string				// Base64-encoded key (mode 0600)
+	MaxSkew time.Duration			// Clock skew tolerated by verifiers
+	key []byte
+}
+
+// Init converts settings to runtime units and loads the signing key.
+func (this *Signing) Init() (error) {
+
+	if this.MaxSkew *= time.Second; this.MaxSkew == 0 {
+		this.MaxSkew = 5 * time.Minute
+	}
+
+	if this.KeyFile == `` {
+		return nil
+	}
+
+	this.KeyFile = filePath(this.KeyFile)
+
+	key, err := readSigningKey(this.KeyFile)
+
+	if err != nil {
+		return err
+	}
+
+	this.key = key
+	return nil
+}
+
+// Enabled returns true if requests are to be signed.
+func (this *Signing) Enabled() (bool) {
+	return len(this.key) > 0
+}
+
+// Sign adds the signing headers to the request, identifying the key by
+// the given key ID.
+func (this *Signing) Sign(req *http.Request, keyID string) (error) {
+
+	var body []byte
+
+	if req.GetBody != nil {
+		if rc, err := req.GetBody(); err != nil {
+			return err
+		} else if body, err = ioutil.ReadAll(rc); err != nil {
+			return err
+		} else {
+			rc.Close()
+		}
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(KeyIDHeader, keyID)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, signature(this.key,
+		canonicalRequest(req.Method, req.URL.RequestURI(), ts, body),
+	))
+
+	return nil
+}
+
+// canonicalRequest returns the string that is signed for a request: the
+// method, the path and query, the Unix timestamp, and the hex-encoded
+// SHA-256 hash of the body, each on its own line.
+func canonicalRequest(method, uri, ts string, body []byte) (string) {
+
+	sum := sha256.Sum256(body)
+
+	return strings.Join([]string{method, uri, ts, hex.EncodeToString(sum[:])}, "\n")
+}
+
+// signature returns the base64-encoded HMAC-SHA256 of the canonical request.
+func signature(key []byte, canon string) (string) {
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(canon))
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignature checks the signing headers of a received request. The
+// key for the X-Key-ID header is obtained with the keys function, and the
+// timestamp must be within maxSkew of the current time. The request body
+// is read and replaced so that it can still be read by the caller.
+func verifySignature(r *http.Request, keys func(id string) ([]byte, bool), maxSkew time.Duration) (error) {
+
+	id, ts, sig := r.Header.Get(KeyIDHeader), r.Header.Get(TimestampHeader), r.Header.Get(SignatureHeader)
+
+	if id == `` || ts == `` || sig == `` {
+		return fmt.Errorf(`request not signed`)
+	}
+
+	key, ok := keys(id)
+
+	if !ok {
+		return fmt.Errorf(`unknown signing key '%s'`, id)
+	}
+
+	secs, err := strconv.ParseInt(ts, 10, 64)
+
+	if err != nil {
+		return fmt.Errorf(`invalid timestamp '%s'`, ts)
+	}
+
+	if skew := time.Since(time.Unix(secs, 0)); skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf(`timestamp %s outside allowed skew of %s`, ts, maxSkew)
+	}
+
+	var body []byte
+
+	if r.Body != nil {
+		if body, err = ioutil.ReadAll(r.Body); err != nil {
+			return err
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	want := signature(key, canonicalRequest(r.Method, r.URL.RequestURI(), ts, body))
+
+	if !hmac.Equal([]byte(sig), []byte(want)) {
+		return fmt.Errorf(`signature mismatch`)
+	}
+
+	return nil
+}
+
+// readSigningKey reads a base64-encoded signing key from a file that must
+// not be accessible to other users.
+func readSigningKey(fn string) ([]byte, error) {
+
+	fi, err := os.Stat(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkPrivate(`signing key file`, fn, fi); err != nil {
+		return nil, err
+	}
+
+	b, err := ioutil.ReadFile(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(b)))
+
+	if err != nil {
+		return nil, fmt.Errorf(`signing key file %s unreadable - %v`, fn, err)
+	} else if len(key) < minKeyLen {
+		return nil, fmt.Errorf(`signing key in %s shorter than %d bytes`, fn, minKeyLen)
+	}
+
+	return key, nil
+}
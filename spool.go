@@ -0,0 +1,186 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`context`
+	`crypto/sha256`
+	`encoding/json`
+	`fmt`
+	`io/ioutil`
+	`os`
+	`path/filepath`
+	`sort`
+	`strings`
+	`time`
+)
+
+const (
+	SpoolExt = `.json`
+	RejectExt = `.rejected`
+)
+
+// Spool is a disk-backed queue of API submissions that could not be
+// delivered to the server. Entries are stored one per file and are
+// replayed in the order they were queued.
+type Spool struct {
+	Dir string
+}
+
+// SpoolEntry is a single undelivered API submission.
+type SpoolEntry struct {
+	Endpoint string			// Key of the endpoint in Server.Endpoints
+	Params []string			// URL parameters for the endpoint
+	Body json.RawMessage		// JSON request body
+	Time time.Time			// Time the submission was first attempted
+}
+
+// Hash returns a digest of the submission content used to detect
+// duplicate entries. The timestamp is not part of the digest.
+func (this *SpoolEntry) Hash() (string) {
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n", this.Endpoint, strings.Join(this.Params, "\n"))
+	h.Write(this.Body)
+
+	return fmt.Sprintf(`%x`, h.Sum(nil))[:16]
+}
+
+// Put queues a submission for later delivery. Submissions identical to
+// one already in the spool are discarded.
+func (this *Spool) Put(key string, params []string, body []byte) (error) {
+
+	e := &SpoolEntry{
+		Endpoint: key,
+		Params: params,
+		Body: json.RawMessage(body),
+		Time: time.Now(),
+	}
+
+	hash := e.Hash()
+
+	if dups, err := filepath.Glob(filepath.Join(this.Dir, `*-` + hash + SpoolExt)); err != nil {
+		return err
+	} else if len(dups) > 0 {
+		sl.Printf(`spool already holds %s %s, not queued again`,
+			key, strings.Join(params, `-`),
+		)
+		return nil
+	}
+
+	b, err := json.Marshal(e)
+
+	if err != nil {
+		return err
+	}
+
+	fn := filepath.Join(this.Dir, fmt.Sprintf(`%020d-%s%s`, e.Time.UnixNano(), hash, SpoolExt))
+
+	if err := ioutil.WriteFile(fn, b, FileMode); err != nil {
+		return err
+	}
+
+	sl.Printf(`spooled %s %s for later delivery`, key, strings.Join(params, `-`))
+	return nil
+}
+
+// Entries returns the files of all queued submissions in delivery order.
+func (this *Spool) Entries() ([]string, error) {
+
+	fns, err := filepath.Glob(filepath.Join(this.Dir, `*` + SpoolExt))
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(fns)
+	return fns, nil
+}
+
+// Flush delivers queued submissions to the server in order. Delivery stops
+// at the first submission the server cannot be reached for, leaving it and
+// all later submissions in the spool. Submissions the server rejects are
+// set aside so they do not block the queue. It returns the number of
+// submissions the server accepted and the number it rejected.
+func (this *Spool) Flush(ctx context.Context) (n, rejected int, err error) {
+
+	fns, err := this.Entries()
+
+	if err != nil || len(fns) == 0 {
+		return 0, 0, err
+	}
+
+	sl.Printf(`spool holds %d undelivered submissions`, len(fns))
+
+	if err := auth(ctx); err != nil {
+		return 0, 0, err
+	}
+
+	for i, fn := range fns {
+
+		e := &SpoolEntry{}
+
+		if err := loadConfig(e, fn); err != nil {
+			el.Printf(`spool entry %s unreadable - %v`, filepath.Base(fn), err)
+			os.Rename(fn, fn + RejectExt)
+			continue
+		}
+
+		octx := startOp(ctx)
+		sent, accepted, err := this.deliver(octx, fn, e)
+		endOp()
+
+		if !sent {
+			return n, rejected, fmt.Errorf(`spool delivery stopped, %d remaining - %v`, len(fns) - i, err)
+		} else if err != nil {
+			return n, rejected, err
+		} else if !accepted {
+			rejected++
+		} else {
+			n++
+		}
+	}
+
+	return n, rejected, nil
+}
+
+// deliver sends one queued submission and removes it from the spool, or
+// sets it aside if the server rejects it. The outcome is logged before the
+// caller ends the operation so that it carries the operation ID. It reports
+// whether the server received the submission and whether it accepted it.
+func (this *Spool) deliver(ctx context.Context, fn string, e *SpoolEntry) (sent, accepted bool, err error) {
+
+	hr, err := httpPost(ctx, endpoint(e.Endpoint, e.Params...), e.Body)
+
+	if undeliverable(hr, err) {
+		if err == nil {
+			err = hr.Err()
+		}
+		return false, false, err
+	}
+
+	if hr.Status().Rejected() {
+		el.Printf(`spooled %s %s queued %s not accepted - %s`,
+			e.Endpoint, strings.Join(e.Params, `-`), e.Time.Format(time.RFC3339), hr.Err(),
+		)
+		return true, false, os.Rename(fn, fn + RejectExt)
+	}
+
+	sl.Printf(`spooled %s %s queued %s accepted - %s`,
+		e.Endpoint, strings.Join(e.Params, `-`), e.Time.Format(time.RFC3339), hr.Status(),
+	)
+
+	return true, true, os.Remove(fn)
+}
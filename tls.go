@@ -0,0 +1,161 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`crypto/sha256`
+	`crypto/tls`
+	`crypto/x509`
+	`encoding/base64`
+	`errors`
+	`fmt`
+	`io/ioutil`
+	`net/http`
+	`strings`
+)
+
+var (
+	TLSVersions = map[string]uint16 {
+
+		`1.0`:	tls.VersionTLS10,
+		`1.1`:	tls.VersionTLS11,
+		`1.2`:	tls.VersionTLS12,
+		`1.3`:	tls.VersionTLS13,
+	}
+)
+
+// TLS holds the settings for secure connections to the server.
+type TLS struct {
+	CAFile string			// PEM bundle of trusted certificate authorities
+	CertFile string			// PEM client certificate for mutual TLS
+	KeyFile string			// PEM private key for the client certificate
+	MinVersion string		// Minimum protocol version
+	ServerName string		// Host name expected in the server certificate
+	Pins []string			// SHA-256 digests of trusted server public keys
+}
+
+// pinError indicates that no certificate presented by the server matched
+// any of the configured public key pins.
+type pinError struct {
+	host string
+}
+
+// Error implements the error interface for pinError.
+func (this *pinError) Error() (string) {
+	return fmt.Sprintf(`no certificate from %s matches a configured public key pin`, this.host)
+}
+
+// Config builds a tls.Config from the settings.
+func (this *TLS) Config() (*tls.Config, error) {
+
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: this.ServerName,
+	}
+
+	if this.MinVersion != `` {
+		if v, ok := TLSVersions[this.MinVersion]; !ok {
+			return nil, fmt.Errorf(`unsupported TLS version '%s'`, this.MinVersion)
+		} else {
+			tc.MinVersion = v
+		}
+	}
+
+	if this.CAFile != `` {
+
+		pool := x509.NewCertPool()
+
+		if b, err := ioutil.ReadFile(filePath(this.CAFile)); err != nil {
+			return nil, err
+		} else if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf(`no certificates found in CA file '%s'`, this.CAFile)
+		}
+
+		tc.RootCAs = pool
+	}
+
+	if this.CertFile != `` || this.KeyFile != `` {
+
+		if cert, err := tls.LoadX509KeyPair(filePath(this.CertFile), filePath(this.KeyFile)); err != nil {
+			return nil, fmt.Errorf(`client certificate not loaded - %v`, err)
+		} else {
+			tc.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	if len(this.Pins) > 0 {
+
+		pins := make(map[string]bool)
+
+		for _, pin := range this.Pins {
+			pins[strings.TrimPrefix(pin, `sha256/`)] = true
+		}
+
+		tc.VerifyConnection = func(cs tls.ConnectionState) (error) {
+
+			for _, cert := range cs.PeerCertificates {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[base64.StdEncoding.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+
+			return &pinError{cs.ServerName}
+		}
+	}
+
+	return tc, nil
+}
+
+// tlsError annotates errors caused by a failed TLS handshake with the
+// likely cause so that they are meaningful in the error log. Other
+// errors are returned unchanged.
+func tlsError(req *http.Request, err error) (error) {
+
+	var (
+		uae x509.UnknownAuthorityError
+		hne x509.HostnameError
+		cie x509.CertificateInvalidError
+		rhe tls.RecordHeaderError
+		pe *pinError
+		cause string
+	)
+
+	switch {
+
+	case errors.As(err, &uae):
+		cause = `server certificate is not signed by a trusted CA (check Server.TLS.CAFile)`
+
+	case errors.As(err, &hne):
+		cause = `server certificate does not match host name (check Server.TLS.ServerName)`
+
+	case errors.As(err, &cie):
+		cause = `server certificate is invalid or expired`
+
+	case errors.As(err, &rhe):
+		cause = `server did not respond with TLS (check Server.Protocol and Server.Port)`
+
+	case errors.As(err, &pe):
+		cause = `server public key is not pinned (check Server.TLS.Pins)`
+
+	case strings.Contains(err.Error(), `tls: `):
+		cause = `handshake refused (check Server.TLS client certificate and MinVersion)`
+
+	default:
+		return err
+	}
+
+	return fmt.Errorf(`TLS handshake with %s failed, %s - %v`, req.URL.Host, cause, err)
+}
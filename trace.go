@@ -0,0 +1,428 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`bytes`
+	`encoding/json`
+	`io/ioutil`
+	`net/http`
+	`net/http/httptrace`
+	`net/url`
+	`strings`
+	`sync`
+	`time`
+)
+
+// Redacted replaces secrets in traces.
+const Redacted = `REDACTED`
+
+// secretFields are the names of body fields and query parameters, in
+// lower case, whose values are redacted from traces.
+var secretFields = map[string]bool{
+	`password`: true,
+	`secret`: true,
+	`client_secret`: true,
+	`token`: true,
+	`access_token`: true,
+	`refresh_token`: true,
+}
+
+// tracer records the HTTP exchanges of the run if the -trace option is set.
+var tracer *Tracer
+
+// roundTripFunc adapts a function to the http.RoundTripper interface.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+// RoundTrip calls the function.
+func (this roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return this(req)
+}
+
+// Tracer is an http.RoundTripper that records each request and response
+// passing through it in an HTTP Archive (HAR) 1.2 file. The file is
+// rewritten after every exchange so that it is complete even if the run
+// ends abruptly. Authorization headers, cookies, which carry the session
+// JWT, and credential fields are redacted.
+type Tracer struct {
+	Transport http.RoundTripper
+	File string
+	mu sync.Mutex
+	har harFile
+}
+
+// newTracer creates a Tracer that records exchanges made with the given
+// transport in the given file.
+func newTracer(rt http.RoundTripper, fn string) (*Tracer) {
+
+	this := &Tracer{Transport: rt, File: fn}
+	this.har.Log.Version = `1.2`
+	this.har.Log.Creator = harCreator{program, version}
+	this.har.Log.Entries = []*harEntry{}
+
+	return this
+}
+
+// RoundTrip sends the request with the underlying transport and records
+// the exchange.
+func (this *Tracer) RoundTrip(req *http.Request) (*http.Response, error) {
+	return this.roundTrip(this.Transport, req)
+}
+
+// Via returns a RoundTripper that sends requests with another transport,
+// such as that of a client for the identity provider, and records the
+// exchanges in the same trace.
+func (this *Tracer) Via(rt http.RoundTripper) (http.RoundTripper) {
+	return roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return this.roundTrip(rt, req)
+	})
+}
+
+// roundTrip sends the request with the given transport and records the
+// exchange.
+func (this *Tracer) roundTrip(rt http.RoundTripper, req *http.Request) (*http.Response, error) {
+
+	var reqBody []byte
+
+	if req.GetBody != nil {
+		if rc, err := req.GetBody(); err == nil {
+			reqBody, _ = ioutil.ReadAll(rc)
+			rc.Close()
+		}
+	}
+
+	var gotConn, wrote, firstByte time.Time
+
+	ct := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { gotConn = time.Now() },
+		WroteRequest: func(httptrace.WroteRequestInfo) { wrote = time.Now() },
+		GotFirstResponseByte: func() { firstByte = time.Now() },
+	}
+
+	start := time.Now()
+	resp, err := rt.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), ct)))
+
+	var respBody []byte
+
+	if err == nil {
+		respBody, err = ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+	}
+
+	end := time.Now()
+
+	entry := &harEntry{
+		StartedDateTime: start.Format(time.RFC3339Nano),
+		Request: harRequestOf(req, reqBody),
+		Response: harResponseOf(resp, respBody),
+		Cache: struct{}{},
+		Timings: harTimings{
+			Blocked: millis(start, gotConn),
+			DNS: -1,
+			Connect: -1,
+			Send: millis(gotConn, wrote),
+			Wait: millis(wrote, firstByte),
+			Receive: millis(firstByte, end),
+			SSL: -1,
+		},
+		Time: millis(start, end),
+	}
+
+	if err != nil {
+		entry.Error = err.Error()
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.har.Log.Entries = append(this.har.Log.Entries, entry)
+
+	if serr := this.save(); serr != nil {
+		el.Printf(`trace %s not saved - %v`, this.File, serr)
+	}
+
+	// A response whose body could not be read is recorded but not returned,
+	// since a RoundTripper must not return both a response and an error.
+
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// save writes the trace to the trace file.
+func (this *Tracer) save() (error) {
+
+	if b, err := json.MarshalIndent(&this.har, ``, "\t"); err != nil {
+		return err
+	} else {
+		return ioutil.WriteFile(this.File, b, FileMode)
+	}
+}
+
+// harFile is the root of an HTTP Archive.
+type harFile struct {
+	Log struct {
+		Version string			`json:"version"`
+		Creator harCreator		`json:"creator"`
+		Entries []*harEntry		`json:"entries"`
+	}					`json:"log"`
+}
+
+// harCreator identifies the application that created the archive.
+type harCreator struct {
+	Name string				`json:"name"`
+	Version string				`json:"version"`
+}
+
+// harEntry is one request and its response.
+type harEntry struct {
+	StartedDateTime string			`json:"startedDateTime"`
+	Time float64				`json:"time"`
+	Request *harRequest			`json:"request"`
+	Response *harResponse			`json:"response"`
+	Cache struct{}				`json:"cache"`
+	Timings harTimings			`json:"timings"`
+	Error string				`json:"_error,omitempty"`
+}
+
+// harRequest is a recorded request.
+type harRequest struct {
+	Method string				`json:"method"`
+	URL string				`json:"url"`
+	HTTPVersion string			`json:"httpVersion"`
+	Cookies []harNameValue			`json:"cookies"`
+	Headers []harNameValue			`json:"headers"`
+	QueryString []harNameValue		`json:"queryString"`
+	PostData *harPostData			`json:"postData,omitempty"`
+	HeadersSize int				`json:"headersSize"`
+	BodySize int				`json:"bodySize"`
+}
+
+// harResponse is a recorded response. Status is zero if no response was
+// received.
+type harResponse struct {
+	Status int				`json:"status"`
+	StatusText string			`json:"statusText"`
+	HTTPVersion string			`json:"httpVersion"`
+	Cookies []harNameValue			`json:"cookies"`
+	Headers []harNameValue			`json:"headers"`
+	Content harContent			`json:"content"`
+	RedirectURL string			`json:"redirectURL"`
+	HeadersSize int				`json:"headersSize"`
+	BodySize int				`json:"bodySize"`
+}
+
+// harNameValue is a header, cookie, or query parameter.
+type harNameValue struct {
+	Name string				`json:"name"`
+	Value string				`json:"value"`
+}
+
+// harPostData is a recorded request body.
+type harPostData struct {
+	MimeType string				`json:"mimeType"`
+	Text string				`json:"text"`
+}
+
+// harContent is a recorded response body.
+type harContent struct {
+	Size int				`json:"size"`
+	MimeType string				`json:"mimeType"`
+	Text string				`json:"text"`
+}
+
+// harTimings are the durations of the phases of an exchange in
+// milliseconds; -1 marks phases that were not measured.
+type harTimings struct {
+	Blocked float64				`json:"blocked"`
+	DNS float64				`json:"dns"`
+	Connect float64				`json:"connect"`
+	Send float64				`json:"send"`
+	Wait float64				`json:"wait"`
+	Receive float64				`json:"receive"`
+	SSL float64				`json:"ssl"`
+}
+
+// harRequestOf records a request with secrets redacted.
+func harRequestOf(req *http.Request, body []byte) (*harRequest) {
+
+	u := *req.URL
+	q := u.Query()
+
+	for k := range q {
+		if secretFields[strings.ToLower(k)] {
+			q.Set(k, Redacted)
+		}
+	}
+
+	u.RawQuery = q.Encode()
+	u.User = nil
+
+	this := &harRequest{
+		Method: req.Method,
+		URL: u.String(),
+		HTTPVersion: req.Proto,
+		Cookies: []harNameValue{},
+		Headers: harHeaders(req.Header),
+		QueryString: harValues(q),
+		HeadersSize: -1,
+		BodySize: len(body),
+	}
+
+	for _, c := range req.Cookies() {
+		this.Cookies = append(this.Cookies, harNameValue{c.Name, Redacted})
+	}
+
+	if body != nil {
+		ct := req.Header.Get(`Content-Type`)
+		this.PostData = &harPostData{ct, redactBody(ct, body)}
+	}
+
+	return this
+}
+
+// harResponseOf records a response with secrets redacted.
+func harResponseOf(resp *http.Response, body []byte) (*harResponse) {
+
+	this := &harResponse{
+		Cookies: []harNameValue{},
+		Headers: []harNameValue{},
+		HeadersSize: -1,
+		BodySize: -1,
+	}
+
+	if resp == nil {
+		return this
+	}
+
+	ct := resp.Header.Get(`Content-Type`)
+
+	this.Status = resp.StatusCode
+	this.StatusText = http.StatusText(resp.StatusCode)
+	this.HTTPVersion = resp.Proto
+	this.Headers = harHeaders(resp.Header)
+	this.Content = harContent{len(body), ct, redactBody(ct, body)}
+	this.RedirectURL = resp.Header.Get(`Location`)
+	this.BodySize = len(body)
+
+	for _, c := range resp.Cookies() {
+		this.Cookies = append(this.Cookies, harNameValue{c.Name, Redacted})
+	}
+
+	return this
+}
+
+// harHeaders records headers, redacting credentials and cookies.
+func harHeaders(h http.Header) ([]harNameValue) {
+
+	nvs := []harNameValue{}
+
+	for k, vs := range h {
+		for _, v := range vs {
+			switch http.CanonicalHeaderKey(k) {
+			case `Authorization`, `Proxy-Authorization`, `Cookie`, `Set-Cookie`:
+				v = Redacted
+			}
+			nvs = append(nvs, harNameValue{k, v})
+		}
+	}
+
+	return nvs
+}
+
+// harValues records query parameters or form fields.
+func harValues(vals url.Values) ([]harNameValue) {
+
+	nvs := []harNameValue{}
+
+	for k, vs := range vals {
+		for _, v := range vs {
+			nvs = append(nvs, harNameValue{k, v})
+		}
+	}
+
+	return nvs
+}
+
+// redactBody returns the body as text with the values of credential fields
+// redacted from JSON and form-encoded bodies.
+func redactBody(ct string, body []byte) (string) {
+
+	switch {
+
+	case strings.HasPrefix(ct, `application/x-www-form-urlencoded`):
+
+		if vals, err := url.ParseQuery(string(body)); err == nil {
+			for k := range vals {
+				if secretFields[strings.ToLower(k)] {
+					vals.Set(k, Redacted)
+				}
+			}
+			return vals.Encode()
+		}
+
+	case json.Valid(body):
+
+		var v interface{}
+
+		if err := json.Unmarshal(body, &v); err == nil && redactJSON(v) {
+			if b, err := json.Marshal(v); err == nil {
+				return string(b)
+			}
+		}
+	}
+
+	return string(body)
+}
+
+// redactJSON redacts the values of credential fields anywhere in a decoded
+// JSON document and returns true if any were found.
+func redactJSON(v interface{}) (found bool) {
+
+	switch t := v.(type) {
+
+	case map[string]interface{}:
+		for k, mv := range t {
+			if secretFields[strings.ToLower(k)] {
+				t[k], found = Redacted, true
+			} else if redactJSON(mv) {
+				found = true
+			}
+		}
+
+	case []interface{}:
+		for _, e := range t {
+			if redactJSON(e) {
+				found = true
+			}
+		}
+	}
+
+	return found
+}
+
+// millis returns the milliseconds between two times, or -1 if either was
+// not recorded.
+func millis(from, to time.Time) (float64) {
+
+	if from.IsZero() || to.IsZero() {
+		return -1
+	}
+
+	return float64(to.Sub(from)) / float64(time.Millisecond)
+}
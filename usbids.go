@@ -0,0 +1,304 @@
+// Copyright 2017 John Scherff
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	`bufio`
+	`bytes`
+	`context`
+	`fmt`
+	`io`
+	`io/ioutil`
+	`net/http`
+	`os`
+	`path/filepath`
+	`strings`
+)
+
+// UsbIDs is a USB ID database in the format of the usb.ids file maintained
+// at http://www.linux-usb.org/usb-ids.html. Only vendors, products, classes,
+// subclasses, and protocols are kept; other sections are skipped.
+type UsbIDs struct {
+	Vendors map[string]*UsbVendor
+	Classes map[string]*UsbClass
+}
+
+// UsbVendor is a vendor and its products.
+type UsbVendor struct {
+	Name string
+	Products map[string]string
+}
+
+// UsbClass is a device class and its subclasses.
+type UsbClass struct {
+	Name string
+	SubClasses map[string]*UsbSubClass
+}
+
+// UsbSubClass is a device subclass and its protocols.
+type UsbSubClass struct {
+	Name string
+	Protocols map[string]string
+}
+
+// loadUsbIDs reads and parses a usb.ids file.
+func loadUsbIDs(fn string) (*UsbIDs, error) {
+
+	fh, err := os.Open(fn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer fh.Close()
+	return parseUsbIDs(fh)
+}
+
+// parseUsbIDs parses a database in usb.ids format. Each entry is an ID and
+// a name separated by whitespace; an entry's children follow it, indented
+// by one more tab. Vendors are top-level entries with four-digit IDs and
+// classes are top-level entries introduced with 'C'.
+func parseUsbIDs(r io.Reader) (*UsbIDs, error) {
+
+	this := &UsbIDs{
+		Vendors: make(map[string]*UsbVendor),
+		Classes: make(map[string]*UsbClass),
+	}
+
+	var (
+		vendor *UsbVendor
+		class *UsbClass
+		subclass *UsbSubClass
+	)
+
+	scanner := bufio.NewScanner(r)
+
+	for n := 1; scanner.Scan(); n++ {
+
+		line := strings.TrimRight(scanner.Text(), " \r")
+
+		if line == `` || strings.HasPrefix(line, `#`) {
+			continue
+		}
+
+		depth := len(line) - len(strings.TrimLeft(line, "\t"))
+		id, name := splitUsbID(line[depth:])
+
+		switch {
+
+		case depth == 0 && id == `c`:
+
+			vendor, subclass = nil, nil
+			id, name = splitUsbID(name)
+
+			if !isHex(id, 2) {
+				return nil, fmt.Errorf(`usb.ids line %d: invalid class '%s'`, n, id)
+			}
+
+			class = &UsbClass{name, make(map[string]*UsbSubClass)}
+			this.Classes[id] = class
+
+		case depth == 0 && isHex(id, 4):
+
+			class, subclass = nil, nil
+			vendor = &UsbVendor{name, make(map[string]string)}
+			this.Vendors[id] = vendor
+
+		case depth == 0:
+
+			// Another section, such as AT, HID, or L.
+
+			vendor, class, subclass = nil, nil, nil
+
+		case depth == 1 && vendor != nil && isHex(id, 4):
+			vendor.Products[id] = name
+
+		case depth == 1 && class != nil && isHex(id, 2):
+			subclass = &UsbSubClass{name, make(map[string]string)}
+			class.SubClasses[id] = subclass
+
+		case depth == 2 && subclass != nil && isHex(id, 2):
+			subclass.Protocols[id] = name
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// splitUsbID splits an entry into its ID and name.
+func splitUsbID(s string) (id, name string) {
+
+	if i := strings.IndexAny(s, " \t"); i < 0 {
+		return strings.ToLower(s), ``
+	} else {
+		return strings.ToLower(s[:i]), strings.TrimSpace(s[i:])
+	}
+}
+
+// isHex returns true if the string is a hexadecimal number of n digits.
+func isHex(s string, n int) (bool) {
+
+	if len(s) != n {
+		return false
+	}
+
+	for _, c := range s {
+		if !strings.ContainsRune(`0123456789abcdef`, c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Vendor returns the name of the vendor.
+func (this *UsbIDs) Vendor(vid string) (string, bool) {
+
+	if v, ok := this.Vendors[strings.ToLower(vid)]; ok {
+		return v.Name, true
+	}
+
+	return ``, false
+}
+
+// Product returns the name of the vendor's product.
+func (this *UsbIDs) Product(vid, pid string) (string, bool) {
+
+	if v, ok := this.Vendors[strings.ToLower(vid)]; ok {
+		s, ok := v.Products[strings.ToLower(pid)]
+		return s, ok
+	}
+
+	return ``, false
+}
+
+// Class returns the name of the device class.
+func (this *UsbIDs) Class(cid string) (string, bool) {
+
+	if c, ok := this.Classes[strings.ToLower(cid)]; ok {
+		return c.Name, true
+	}
+
+	return ``, false
+}
+
+// SubClass returns the name of the class's subclass.
+func (this *UsbIDs) SubClass(cid, sid string) (string, bool) {
+
+	if c, ok := this.Classes[strings.ToLower(cid)]; ok {
+		if s, ok := c.SubClasses[strings.ToLower(sid)]; ok {
+			return s.Name, true
+		}
+	}
+
+	return ``, false
+}
+
+// Protocol returns the name of the subclass's protocol.
+func (this *UsbIDs) Protocol(cid, sid, pid string) (string, bool) {
+
+	if c, ok := this.Classes[strings.ToLower(cid)]; ok {
+		if s, ok := c.SubClasses[strings.ToLower(sid)]; ok {
+			p, ok := s.Protocols[strings.ToLower(pid)]
+			return p, ok
+		}
+	}
+
+	return ``, false
+}
+
+// importUsbIDs obtains a usb.ids file from a local path or URL, verifies
+// that it can be parsed, and replaces the configured database with it.
+func importUsbIDs(ctx context.Context, src, dst string) (error) {
+
+	var (
+		b []byte
+		err error
+	)
+
+	if strings.HasPrefix(src, `http://`) || strings.HasPrefix(src, `https://`) {
+		b, err = downloadUsbIDs(ctx, src)
+	} else {
+		b, err = ioutil.ReadFile(src)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	ids, err := parseUsbIDs(bytes.NewReader(b))
+
+	if err != nil {
+		return err
+	} else if len(ids.Vendors) == 0 {
+		return fmt.Errorf(`%s contains no USB vendors`, src)
+	}
+
+	if _, err := makePath(filepath.Dir(dst)); err != nil {
+		return err
+	}
+
+	tmp := dst + `.tmp`
+
+	if err := ioutil.WriteFile(tmp, b, FileMode); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	sl.Printf(`imported %d vendors and %d classes from %s to %s`,
+		len(ids.Vendors), len(ids.Classes), src, dst,
+	)
+
+	return nil
+}
+
+// downloadUsbIDs retrieves a usb.ids file through the configured proxy.
+// The server's TLS settings do not apply to the download site.
+func downloadUsbIDs(ctx context.Context, url string) ([]byte, error) {
+
+	hc, err := externalClient()
+
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := hc.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf(`%s not downloaded - %s`, url, httpStatus(resp.StatusCode))
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}